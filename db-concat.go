@@ -1,34 +1,233 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"os/exec"
+	"path"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/term"
 )
 
 type ConcatItem struct {
-	IsFile  bool
-	Value   string
-	BaseDir string // New field to store the base directory for path resolution
+	IsFile     bool
+	IsWriteTo  bool         // Switches the output target to Value for all subsequent items
+	IsBase64   bool         // With IsFile, the file's contents are written base64-encoded
+	IsTemplate bool         // With IsFile, parameters and escapes in the file's contents are substituted
+	IsLiteral  bool         // With IsFile, the file's contents are written as a quoted SQL string literal
+	Filters    []lineFilter // With IsFile, only the lines passing all filters are written
+	Pipeline   []string     // With IsFile, the named filters applied in order to each line, after Filters
+	Head       int          // With IsFile and if positive, only the first Head lines of the file are used
+	Tail       int          // With IsFile and if positive, only the last Tail lines (of the first Head) are used
+	IsZip      bool         // Value is "archive.zip:entry", where entry may be a pattern matching several entries
+	IsTime     bool         // Value is a Go time layout; the time at which the item is written is written in it
+	IsTempFile bool         // Value is the path of a temporary file holding the text of a large text block
+	IsResolved bool         // Value's parameters were substituted when it was added; the final pass leaves it alone
+	Value      string
+	BaseDir    string // New field to store the base directory for path resolution
+}
+
+// lineFilter is a "grep" clause of a concat command. A line passes it if it matches
+// the pattern, or for "grep -v", if it does not.
+type lineFilter struct {
+	pattern *regexp.Regexp
+	invert  bool
+}
+
+// lineStage is an instance of a named filter, for one file. It is given each line
+// with its line ending and returns the lines to pass on, none to drop the line. At
+// the end of the file it is called once more with done set, to return any lines it
+// has held back.
+type lineStage func(line string, done bool) []string
+
+// namedFilters are the filters that can follow "|" in a concat command. Each call
+// returns a new stage, so that filters keeping state start afresh for every file.
+var namedFilters = map[string]func() lineStage{
+	"uppercase":        func() lineStage { return mapLines(strings.ToUpper) },
+	"lowercase":        func() lineStage { return mapLines(strings.ToLower) },
+	"strip-comments":   newStripCommentsStage,
+	"trim-blank-lines": newTrimBlankLinesStage,
+}
+
+// ManifestEntry describes one item written during a run, for --manifest.
+type ManifestEntry struct {
+	Type  string `json:"type"`           // "file", "base64", "template", "sql-literal", "zip", "text", "timestamp", "write-to", "header" or "footer"
+	Path  string `json:"path,omitempty"` // Resolved path, with forward slashes on every platform
+	Bytes int64  `json:"bytes"`
 }
 
+// defaultBufferSize is the default output buffer size. It turns the writes of many
+// small items into few large ones; for small files, opening and closing each file
+// costs far more, so BenchmarkRunConcat shows little difference between buffer sizes.
+const defaultBufferSize = 64 * 1024
+
+// errNoOutput is returned by runConcat for --fail-on-empty-output.
+var errNoOutput = errors.New("no output was written")
+
+// errOutputTooLarge is returned by runConcat when the output would exceed --max-output-size.
+var errOutputTooLarge = errors.New("output exceeds --max-output-size")
+
+// errOutputDiffers is returned by generate with --diff when the output file would change.
+var errOutputDiffers = errors.New("output file is not up to date")
+
+// watchSettleDelay is how long --watch waits after a change for further changes
+// before regenerating.
+const watchSettleDelay = 100 * time.Millisecond
+
+// defaultConfigFile is read for default flag values when --config is not given.
+const defaultConfigFile = ".db-concat.conf"
+
 var (
-	paramFiles  string
-	paramsSlice stringArray
-	outputFlag  string
-	cliParamsSet map[string]bool // New: To track parameters set by CLI --param
+	paramFiles      string
+	dotenvFiles     string
+	envPrefix       string
+	paramsSlice     stringArray
+	outputFlag      string
+	stdinParams     stringArray
+	fileParams      stringArray
+	configFile      string
+	timestampFmt    string
+	failOnEmpty     bool
+	outputMode      string
+	lineEndings     string
+	warnAsError     bool
+	manifestFile    string
+	bufferSize      int
+	globOrder       string
+	allowExec       bool
+	watchMode       bool
+	dumpParams      string
+	outputDir       string
+	colorMode       string
+	sinceFlag       string
+	untilFlag       string
+	traceMode       bool
+	quietMode       bool
+	atomicWrite     bool
+	maxSizeFlag     string
+	paramFileSub    bool
+	concatOrder     string
+	validateOnly    bool
+	diffMode        bool
+	commentChar     string
+	keepGoing       bool
+	promptMissing   bool
+	overrideFiles   string
+	logFormat       string
+	graphFile       string
+	preservePerms   bool
+	profile         string
+	profilePattern  string
+	lockOutput      bool
+	textSpillSize   int
+	substitutePaths bool
+	unresolvedFile  string
+	stdoutAlso      bool
+	sqlDialect      string
+	inputRoot       string // With --input-root, the root as an absolute path with symbolic links resolved
+	skipEmpty       bool
+	indexOutOfRange string
+	maxOutput       int64 // Parsed --max-output-size; 0 for no limit
+	onMissing       string
+	headerFile      string
+	footerText      string
+	sinceTime       time.Time       // Parsed --since; zero if not given
+	untilTime       time.Time       // Parsed --until; zero if not given
+	useColor        bool            // Whether diagnostics on stderr are colorized, decided from --color
+	builtinNames    map[string]bool // Read-only builtin parameters such as __TIMESTAMP__
+	lazyParams      map[string]bool // Parameters whose values are substituted only in the final pass (set-lazy)
+	cliParamsSet    map[string]bool // New: To track parameters set by CLI --param, and by --param-override-file
+
+	pendingOutputs  []string           // With --atomic, output files of the current run still written to <path>.tmp
+	indexErr        error              // First out-of-range ${KEY[n]} of the current run, with --index-out-of-range error
+	includeDepth    int                // How many includes deep the line being processed is; 0 in the main instructions file
+	includedFiles   map[string]bool    // Absolute paths of the instructions files processed in the current run, for include-once
+	includeChain    []string           // Absolute paths of the instructions files being processed, outermost first
+	referencedFiles []string           // Instructions and concatenated files used by the current run, for --watch
+	includeEdges    []includeEdge      // The includes of the current run, in order, for --graph
+	replacements    []replacement      // The replace commands of the current run, in order
+	sections        map[string]section // Sections defined by define-section, visible across includes
+	tempFiles       []string           // Temporary files holding large text blocks, removed at the end of the run
 )
 
+// outputPerm holds the permissions for created output files, parsed from --output-mode.
+var outputPerm os.FileMode = 0666
+
 func init() {
 	flag.StringVar(&paramFiles, "param-file", "", "Comma-separated list of parameter files (key=value per line)")
+	flag.StringVar(&dotenvFiles, "dotenv", "", "Comma-separated list of .env files (KEY=value per line, with optional 'export ' prefix and quoted values). Same precedence as --param-file.")
+	flag.StringVar(&envPrefix, "env-prefix", "", "Import environment variables whose names start with this prefix as parameters, with the prefix removed (e.g., DBCONCAT_).")
 	flag.Var(&paramsSlice, "param", "Key-value pair parameter (e.g., --param key=value). Can be specified multiple times.")
 	flag.StringVar(&outputFlag, "output", "", "Output file path. If not specified, output goes to stdout.")
+	flag.Var(&fileParams, "define-from-file", "KEY=path: set parameter KEY to the contents of the file at path, without one trailing newline. Same precedence as --param. Can be specified multiple times.")
+	flag.Var(&stdinParams, "stdin-param", "Name of a parameter whose value is read as a line from stdin (keeps secrets out of process listings). Can be specified multiple times.")
+	flag.StringVar(&configFile, "config", "", "Config file providing default flag values (key=value per line). Defaults to "+defaultConfigFile+" in the current directory if present.")
+	flag.StringVar(&timestampFmt, "timestamp-format", time.RFC3339, "Go time layout used for the __TIMESTAMP__ builtin parameter.")
+	flag.BoolVar(&failOnEmpty, "fail-on-empty-output", false, "Fail if no bytes were written to the output.")
+	flag.StringVar(&outputMode, "output-mode", "", "Octal permissions for output files (e.g., 0600). If not specified, files are created with 0666 before the umask.")
+	flag.StringVar(&lineEndings, "line-endings", "", "Normalize line endings in the output to lf or crlf. If not specified, line endings are copied unchanged.")
+	flag.BoolVar(&warnAsError, "werror", false, "Treat warnings from the warn command as errors.")
+	flag.StringVar(&manifestFile, "manifest", "", "Write a JSON description of the written items (type, resolved path, byte count) to this file after a successful run.")
+	flag.IntVar(&bufferSize, "buffer-size", defaultBufferSize, "Size in bytes of the buffer used when writing output files.")
+	flag.StringVar(&globOrder, "glob-order", "name", "Order of the files added by concat-dir and concat-tree: name, natural (file2 before file10) or mtime (oldest first).")
+	flag.BoolVar(&allowExec, "allow-exec", false, "Allow the exec command to run shell commands.")
+	flag.BoolVar(&watchMode, "watch", false, "Keep running and regenerate the output whenever the instructions or a file used by them changes.")
+	flag.StringVar(&dumpParams, "dump-params", "", "After a successful run, write the final parameters to this file as key=value lines, readable by --param-file.")
+	flag.StringVar(&outputDir, "output-dir", "", "Directory under which relative output paths (from --output, output and write-to) are created.")
+	flag.StringVar(&colorMode, "color", "auto", "Colorize errors and warnings on stderr: auto (when stderr is a terminal), always or never.")
+	flag.StringVar(&sinceFlag, "since", "", "Only add files modified at or after this time to concat-dir and concat-tree: an RFC 3339 time or a duration before now (e.g., 24h).")
+	flag.StringVar(&untilFlag, "until", "", "Only add files modified at or before this time to concat-dir and concat-tree: an RFC 3339 time or a duration before now (e.g., 1h).")
+	flag.BoolVar(&traceMode, "trace", false, "Log every DSL command to stderr as it is dispatched, with whether it runs, the if depth and the active prefix.")
+	flag.StringVar(&onMissing, "on-missing-file", "error", "What to do when a concatenated file does not exist: error, or skip it with a warning.")
+	flag.StringVar(&headerFile, "header-file", "", "File written, with parameters substituted, at the start of the output and of every write-to file.")
+	flag.StringVar(&footerText, "footer-text", "", "Text written, with parameters substituted, at the end of the output and of every write-to file. Supports the emit escapes such as @@n.")
+	flag.BoolVar(&quietMode, "quiet", false, "Do not print the success message, warnings or --watch status lines; errors are still printed.")
+	flag.BoolVar(&atomicWrite, "atomic", false, "Write each output file to <path>.tmp and rename it to <path> only when the run succeeds; on failure the temporary files are removed.")
+	flag.StringVar(&maxSizeFlag, "max-output-size", "", "Fail when more than this many bytes would be written in total, e.g. 1048576, 512KB, 10MB or 1GB. If not specified, there is no limit.")
+	flag.BoolVar(&paramFileSub, "param-file-substitute", false, "Substitute ${KEY} references in --param-file values with the parameters loaded so far.")
+	flag.StringVar(&concatOrder, "concat-order", "normal", "Order in which the gathered items are written: normal, or reverse (within each output file).")
+	flag.BoolVar(&validateOnly, "validate", false, "Check the instructions and that every file to concatenate exists, without writing any output.")
+	flag.BoolVar(&skipEmpty, "skip-empty-files", false, "Leave out concatenated files that are empty (zero bytes).")
+	flag.StringVar(&indexOutOfRange, "index-out-of-range", "empty", "What ${KEY[n]} yields for an index past the end of the list: empty, or error.")
+	flag.BoolVar(&diffMode, "diff", false, "Print a unified diff between the output file and what would be generated, without writing it. Exits with status 4 if they differ.")
+	flag.StringVar(&commentChar, "comment-char", "#", "Character that starts a comment line in instructions and parameter files. Trailing comments are always started by #.")
+	flag.BoolVar(&keepGoing, "keep-going", false, "Carry on after errors such as unknown commands and missing files, and report them all at the end. Unclosed blocks, invalid conditions and abort still stop at once.")
+	flag.BoolVar(&promptMissing, "prompt-missing", false, "Prompt on the terminal, with hidden input, for parameters that are referenced but not set. Without a terminal, such a parameter is an error.")
+	flag.StringVar(&overrideFiles, "param-override-file", "", "Comma-separated list of parameter files whose values override all other sources, including --param, and cannot be changed by the instructions.")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of errors, warnings, --trace and --watch messages on stderr: text, or json for one JSON object per line.")
+	flag.BoolVar(&stdoutAlso, "stdout-also", false, "Also write the output to stdout when writing it to a file. The success message then goes to stderr.")
+	flag.StringVar(&sqlDialect, "sql-dialect", "standard", "How concat-sql-literal escapes file contents: standard (quotes doubled) or mysql (backslashes and NUL bytes escaped too).")
+	flag.StringVar(&inputRoot, "input-root", "", "Only let the instructions read files inside this directory tree, e.g. for untrusted instructions files. Paths that lead outside it, also through symbolic links, are an error.")
+	flag.StringVar(&unresolvedFile, "report-unresolved", "", "Write each ${...} reference left unresolved after the final substitution pass to this file, with the item it appeared in, without failing.")
+	flag.StringVar(&graphFile, "graph", "", "Write the include tree of the instructions to this file as a Graphviz DOT graph.")
+	flag.BoolVar(&preservePerms, "preserve-permissions", false, "Give the output file the permissions of the first concatenated file. Does nothing when writing to stdout.")
+	flag.StringVar(&profile, "profile", "", "Name of the profile to build, e.g. prod: sets the __PROFILE__ builtin parameter and loads the profile's parameter file, if it exists.")
+	flag.StringVar(&profilePattern, "profile-params", "params.{profile}.txt", "Parameter file loaded for --profile, relative to the instructions file, with {profile} replaced by the profile name. Same precedence as --param-file. Empty to load none.")
+	flag.BoolVar(&substitutePaths, "substitute-file-names", true, "Substitute parameters in file paths, as in concat ${NAME}.sql. With --substitute-file-names=false paths are taken literally, while emitted text is still substituted.")
+	flag.IntVar(&textSpillSize, "text-spill-size", 0, "Text blocks larger than this many bytes are kept in a temporary file instead of in memory until they are written. 0 keeps them all in memory.")
+	flag.BoolVar(&lockOutput, "lock-output", false, "Only the main instructions file may use the output command; an included file that sets the output path is an error.")
 	cliParamsSet = make(map[string]bool) // Initialize the map
+	builtinNames = make(map[string]bool)
+	lazyParams = make(map[string]bool)
 }
 
 func main() {
@@ -40,12 +239,133 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err := applyConfigFile(configFile); err != nil {
+		printError("Error loading config file: %v\n", err)
+		os.Exit(1)
+	}
+
+	if logFormat != "text" && logFormat != "json" {
+		printError("Error: invalid --log-format %s (expected text or json)\n", logFormat)
+		os.Exit(1)
+	}
+
+	switch colorMode {
+	case "always":
+		useColor = true
+	case "never":
+		useColor = false
+	case "auto":
+		useColor = isTerminal(os.Stderr) && os.Getenv("NO_COLOR") == ""
+	default:
+		printError("Error: invalid --color %s (expected auto, always or never)\n", colorMode)
+		os.Exit(1)
+	}
+
+	if outputMode != "" {
+		mode, err := strconv.ParseUint(outputMode, 8, 32)
+		if err != nil || mode > 0777 {
+			printError("Error: invalid --output-mode %s\n", outputMode)
+			os.Exit(1)
+		}
+		outputPerm = os.FileMode(mode)
+	}
+	if outputMode != "" && preservePerms {
+		printError("Error: --output-mode and --preserve-permissions cannot be used together\n")
+		os.Exit(1)
+	}
+
+	if maxSizeFlag != "" {
+		size, err := parseSize(maxSizeFlag)
+		if err != nil || size <= 0 {
+			printError("Error: invalid --max-output-size %s (expected a positive number of bytes, optionally with KB, MB or GB)\n", maxSizeFlag)
+			os.Exit(1)
+		}
+		maxOutput = size
+	}
+
+	if textSpillSize < 0 {
+		printError("Error: invalid --text-spill-size %d (must not be negative)\n", textSpillSize)
+		os.Exit(1)
+	}
+
+	if bufferSize <= 0 {
+		printError("Error: invalid --buffer-size %d (must be positive)\n", bufferSize)
+		os.Exit(1)
+	}
+
+	if globOrder != "name" && globOrder != "natural" && globOrder != "mtime" {
+		printError("Error: invalid --glob-order %s (expected name, natural or mtime)\n", globOrder)
+		os.Exit(1)
+	}
+
+	if indexOutOfRange != "empty" && indexOutOfRange != "error" {
+		printError("Error: invalid --index-out-of-range %s (expected empty or error)\n", indexOutOfRange)
+		os.Exit(1)
+	}
+
+	if utf8.RuneCountInString(commentChar) != 1 || strings.TrimSpace(commentChar) == "" {
+		printError("Error: invalid --comment-char %q (expected a single character other than whitespace)\n", commentChar)
+		os.Exit(1)
+	}
+
+	if strings.ContainsAny(profile, `/\`) || profile == "." || profile == ".." {
+		printError("Error: invalid --profile %s (a profile name cannot contain path separators)\n", profile)
+		os.Exit(1)
+	}
+
+	if inputRoot != "" {
+		root, err := resolveInputPath(inputRoot)
+		if info, statErr := os.Stat(root); err != nil || statErr != nil || !info.IsDir() {
+			printError("Error: invalid --input-root %s (expected an existing directory)\n", inputRoot)
+			os.Exit(1)
+		}
+		inputRoot = root
+	}
+
+	if _, ok := sqlLiteralEscapers[sqlDialect]; !ok {
+		printError("Error: invalid --sql-dialect %s (expected standard or mysql)\n", sqlDialect)
+		os.Exit(1)
+	}
+
+	if concatOrder != "normal" && concatOrder != "reverse" {
+		printError("Error: invalid --concat-order %s (expected normal or reverse)\n", concatOrder)
+		os.Exit(1)
+	}
+
+	if onMissing != "error" && onMissing != "skip" {
+		printError("Error: invalid --on-missing-file %s (expected error or skip)\n", onMissing)
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	for _, window := range []struct {
+		name  string
+		value string
+		time  *time.Time
+	}{{"since", sinceFlag, &sinceTime}, {"until", untilFlag, &untilTime}} {
+		if window.value == "" {
+			continue
+		}
+		t, err := parseTimeFlag(window.value, now)
+		if err != nil {
+			printError("Error: invalid --%s %s (expected an RFC 3339 time or a duration such as 24h)\n", window.name, window.value)
+			os.Exit(1)
+		}
+		*window.time = t
+	}
+
+	if lineEndings != "" && lineEndings != "lf" && lineEndings != "crlf" {
+		printError("Error: invalid --line-endings %s (expected lf or crlf)\n", lineEndings)
+		os.Exit(1)
+	}
+
 	instructionsFile := flag.Arg(0)
 	instructionsDir := filepath.Dir(instructionsFile)
 	if instructionsDir == "" {
 		instructionsDir = "."
 	}
 	parameters := make(map[string]string)
+	addBuiltinParams(parameters, time.Now())
 
 	// Load parameters from files (lowest precedence)
 	if paramFiles != "" {
@@ -53,335 +373,3628 @@ func main() {
 		for _, file := range files {
 			err := loadParamsFromFile(file, parameters)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error loading parameters from file %s: %v\n", file, err)
+				printError("Error loading parameters from file %s: %v\n", file, err)
 				os.Exit(1)
 			}
 		}
 	}
 
-	// Load parameters from command line (highest precedence) before processing DSL instructions
-	for _, p := range paramsSlice {
-		parts := strings.SplitN(p, "=", 2)
-		if len(parts) == 2 {
-			parameters[parts[0]] = parts[1]
-			cliParamsSet[parts[0]] = true // Mark this parameter as set by CLI
+	// .env files share the precedence of --param-file and are applied after them
+	if dotenvFiles != "" {
+		files := strings.Split(dotenvFiles, ",")
+		for _, file := range files {
+			err := loadParamsFromDotenv(file, parameters)
+			if err != nil {
+				printError("Error loading parameters from .env file %s: %v\n", file, err)
+				os.Exit(1)
+			}
 		}
 	}
 
-	var dslOutputFile string
-	var itemsToConcat []ConcatItem
-
-	err := processInstructions(instructionsFile, &dslOutputFile, &itemsToConcat, parameters, instructionsDir)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error processing instructions: %v\n", err)
-		os.Exit(1)
+	// The profile's parameter file is more specific than the general ones, so it comes after them
+	if profile != "" && profilePattern != "" {
+		file := strings.ReplaceAll(profilePattern, "{profile}", profile)
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(instructionsDir, file)
+		}
+		if _, err := os.Stat(file); err == nil {
+			if err := loadParamsFromFile(file, parameters); err != nil {
+				printError("Error loading parameters for profile %s: %v\n", profile, err)
+				os.Exit(1)
+			}
+		}
 	}
 
-	// Re-substitute now that all parameters are finalized
-	for i := range itemsToConcat {
-		itemsToConcat[i].Value = substituteParams(itemsToConcat[i].Value, parameters)
-	}
-	if dslOutputFile != "" {
-		dslOutputFile = substituteParams(dslOutputFile, parameters)
+	// Environment variables override parameter files but not --param
+	if envPrefix != "" {
+		if err := loadParamsFromEnv(os.Environ(), envPrefix, parameters); err != nil {
+			printError("Error loading parameters from environment: %v\n", err)
+			os.Exit(1)
+		}
 	}
 
-	finalOutputFile := outputFlag
-	if dslOutputFile != "" {
-		finalOutputFile = dslOutputFile // DSL 'output' command overrides command-line flag
+	// Load parameters from command line (highest precedence) before processing DSL instructions
+	for _, p := range paramsSlice {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) == 2 {
+			if err := checkNotBuiltin(parts[0]); err != nil {
+				printError("Error in --param: %v\n", err)
+				os.Exit(1)
+			}
+			parameters[parts[0]] = parts[1]
+			cliParamsSet[parts[0]] = true // Mark this parameter as set by CLI
+		}
 	}
 
-	var outputWriter io.Writer
-	if finalOutputFile == "" {
-		outputWriter = os.Stdout
-	} else {
-		outFile, err := os.Create(finalOutputFile)
+	// Parameters read from stdin share the precedence of --param and are applied after them
+	if len(stdinParams) > 0 {
+		err := loadParamsFromStdin(os.Stdin, stdinParams, parameters)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating output file %s: %v\n", finalOutputFile, err)
+			printError("Error reading parameters from stdin: %v\n", err)
 			os.Exit(1)
 		}
-		defer outFile.Close()
-		outputWriter = outFile
 	}
 
-	err = runConcat(outputWriter, itemsToConcat, parameters)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error during concatenation: %v\n", err)
+	// Parameters read from files also share the precedence of --param and are applied last
+	if err := loadParamsFromFiles(fileParams, parameters); err != nil {
+		printError("Error in --define-from-file: %v\n", err)
 		os.Exit(1)
 	}
 
-}
-
-func loadParamsFromFile(filename string, parameters map[string]string) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("error opening parameter file %s: %v", filename, err)
+	// Override files come last, above --param. Their entries are marked in cliParamsSet
+	// like --param, so that set, param and the other DSL commands leave them alone.
+	if overrideFiles != "" {
+		for _, file := range strings.Split(overrideFiles, ",") {
+			overrides := make(map[string]string)
+			if err := loadParamsFromFile(file, overrides); err != nil {
+				printError("Error loading parameters from override file %s: %v\n", file, err)
+				os.Exit(1)
+			}
+			for name, value := range overrides {
+				parameters[name] = value
+				cliParamsSet[name] = true
+			}
+		}
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	if watchMode {
+		watchAndRegenerate(instructionsFile, instructionsDir, parameters)
+		return
+	}
+	if err := generate(instructionsFile, instructionsDir, parameters); err != nil {
+		if errors.Is(err, errOutputDiffers) {
+			os.Exit(exitDiffers) // The diff has already been printed
 		}
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) == 2 {
-			parameters[parts[0]] = parts[1]
-		} else {
-			return fmt.Errorf("invalid parameter file line format: %s", line)
+		printError("Error %v\n", err)
+		code := exitFailure
+		var codedErr *exitCodeError
+		if errors.As(err, &codedErr) {
+			code = codedErr.code
 		}
+		os.Exit(code)
 	}
-	return scanner.Err()
+
 }
 
-type stringArray []string
+// Exit statuses. Scripts can rely on these values.
+const (
+	exitFailure      = 1 // Invalid options or parameters, --fail-on-empty-output, and other failures
+	exitInstructions = 2 // Invalid instructions, such as an unknown command, an unclosed if or abort
+	exitIO           = 3 // A file or directory that could not be read or written
+	exitDiffers      = 4 // With --diff, the output file is not up to date
+)
 
-func (i *stringArray) String() string {
-	return strings.Join(*i, ",")
+// exitCodeError is an error returned by generate together with the exit status it
+// should cause.
+type exitCodeError struct {
+	code int
+	err  error
 }
 
-func (i *stringArray) Set(value string) error {
-	*i = append(*i, value)
-	return nil
-}
+func (e *exitCodeError) Error() string { return e.err.Error() }
 
-func substituteParams(s string, parameters map[string]string) string {
-	result := s
-	for key, value := range parameters {
-		result = strings.ReplaceAll(result, "$"+"{"+key+"}", value)
+func (e *exitCodeError) Unwrap() error { return e.err }
+
+// DSLErrorKind classifies a DSLError, so that callers can react to a kind of problem
+// without matching error messages.
+type DSLErrorKind int
+
+const (
+	DSLErrorCommand        DSLErrorKind = iota // A command failed, e.g. because of an invalid argument
+	DSLErrorUnknownCommand                     // The command does not exist
+	DSLErrorUnclosedBlock                      // An if, repeat, switch or define-section is not closed
+	DSLErrorUnmatchedBlock                     // An else, endif, endrepeat, case or similar has no opening command
+	DSLErrorCondition                          // An if condition is malformed
+	DSLErrorAbort                              // The abort command was reached
+	DSLErrorAssert                             // The condition of an assert command was false
+)
+
+func (k DSLErrorKind) String() string {
+	switch k {
+	case DSLErrorUnknownCommand:
+		return "unknown command"
+	case DSLErrorUnclosedBlock:
+		return "unclosed block"
+	case DSLErrorUnmatchedBlock:
+		return "unmatched block"
+	case DSLErrorCondition:
+		return "invalid condition"
+	case DSLErrorAbort:
+		return "abort"
+	case DSLErrorAssert:
+		return "assertion failed"
 	}
-	return result
+	return "command failed"
 }
 
-func unescapeString(s string) string {
-	s = strings.ReplaceAll(s, "@@n", "\n")
-	s = strings.ReplaceAll(s, "@@r", "\r")
-	s = strings.ReplaceAll(s, "@@t", "\t")
-	s = strings.ReplaceAll(s, "@@s", " ")
-	return s
+// DSLError is an error in the instructions, together with where it occurred. Its
+// message is that of the underlying error; File and Line are filled in by processLines
+// for the line whose command failed. Errors reading or writing files are not DSLErrors.
+type DSLError struct {
+	File    string
+	Line    int    // 1-based; 0 if the problem is at the end of File, such as an unclosed if
+	Command string // The command word, without any prefix
+	Kind    DSLErrorKind
+	Err     error
 }
 
-type ifStack []bool
+func (e *DSLError) Error() string { return e.Err.Error() }
 
-func (s *ifStack) push(val bool) {
-	*s = append(*s, val)
+func (e *DSLError) Unwrap() error { return e.Err }
+
+// newDSLError returns a DSLError of the given kind, to be located by processLines.
+func newDSLError(kind DSLErrorKind, format string, args ...interface{}) error {
+	return &DSLError{Kind: kind, Err: fmt.Errorf(format, args...)}
 }
 
-func (s *ifStack) pop() (bool, error) {
-	if len(*s) == 0 {
-		return false, fmt.Errorf("pop on empty stack")
+// locateDSLError attaches the location of a failed command to err. An error that is
+// already located, such as one from an included file, is returned unchanged, as are
+// file system errors.
+func locateDSLError(err error, ctx lineContext, command string) error {
+	var dslErr *DSLError
+	if errors.As(err, &dslErr) {
+		if dslErr.File == "" {
+			dslErr.File, dslErr.Line, dslErr.Command = ctx.file, ctx.line, command
+		}
+		return err
 	}
-	val := (*s)[len(*s)-1]
-	*s = (*s)[:len(*s)-1]
-	return val, nil
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return err
+	}
+	return &DSLError{File: ctx.file, Line: ctx.line, Command: command, Kind: DSLErrorCommand, Err: err}
 }
 
-func (s *ifStack) peek() (bool, error) {
-	if len(*s) == 0 {
-		return false, fmt.Errorf("peek on empty stack")
+// keptErrors holds the errors that --keep-going has carried on after, in order.
+var keptErrors []error
+
+// canKeepGoing reports whether processing can carry on after err with --keep-going:
+// after unknown commands, failed commands and asserts, and files that cannot be
+// read. Errors in block structure or conditions, and abort, would leave the rest of
+// the instructions meaningless. Commands that open a block are not skipped either,
+// as their body would then be read as commands.
+func canKeepGoing(err error, command string) bool {
+	switch command {
+	case "repeat", "switch", "define-section", "text-begin":
+		return false
 	}
-	return (*s)[len(*s)-1], nil
+	var dslErr *DSLError
+	if errors.As(err, &dslErr) {
+		return dslErr.Kind == DSLErrorUnknownCommand || dslErr.Kind == DSLErrorCommand || dslErr.Kind == DSLErrorAssert
+	}
+	var pathErr *fs.PathError
+	return errors.As(err, &pathErr)
 }
 
-func evaluateCondition(condition string, parameters map[string]string) (bool, error) {
-	operators := []string{">=", "<=", "=", ">", "<"}
-	var operator, key, expectedValue string
+// reportKeptErrors checks for --keep-going that the files to be concatenated exist,
+// then prints every error carried on after, with its location when known. It returns
+// an exit status error if there were any: an I/O error if they all were, and an
+// error in the instructions otherwise.
+func reportKeptErrors(items []ConcatItem) error {
+	for _, item := range items {
+		if err := validateItem(item); err != nil {
+			keptErrors = append(keptErrors, err)
+		}
+	}
+	if len(keptErrors) == 0 {
+		return nil
+	}
+	code := exitIO
+	for _, err := range keptErrors {
+		var dslErr *DSLError
+		isDSLErr := errors.As(err, &dslErr)
+		switch {
+		case logFormat == "json": // The location goes into fields of its own
+			printError("%v\n", err)
+		case isDSLErr && dslErr.Line > 0:
+			printError("%s:%d: %v\n", dslErr.File, dslErr.Line, err)
+		case isDSLErr:
+			printError("%s: %v\n", dslErr.File, err)
+		default:
+			printError("%v\n", err)
+		}
+		if isDSLErr {
+			code = exitInstructions
+		}
+	}
+	return &exitCodeError{code: code, err: fmt.Errorf("processing instructions: %d error(s)", len(keptErrors))}
+}
 
-	for _, op := range operators {
-		if strings.Contains(condition, op) {
-			parts := strings.SplitN(condition, op, 2)
-			if len(parts) == 2 {
-				operator = op
-				key = parts[0]
-				expectedValue = parts[1]
-				break
+// instructionsError classifies an error from processing the instructions: errors
+// from the file system (such as a missing include) are I/O errors, and all others are
+// errors in the instructions.
+func instructionsError(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return &exitCodeError{code: exitIO, err: fmt.Errorf("processing instructions: %w", err)}
+	}
+	return &exitCodeError{code: exitInstructions, err: fmt.Errorf("processing instructions: %w", err)}
+}
+
+// paramReference matches a plain ${KEY} reference, and the "$" before it if the
+// reference is escaped.
+var paramReference = regexp.MustCompile(`(\$?)\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// promptMissingParams asks on the terminal, for --prompt-missing, for the value of
+// every parameter referenced by the items or the output path but not set, without
+// echoing it. The answers are also stored in baseParameters, so that --watch only
+// asks once. Without a terminal on stdin, it fails for the first such parameter
+// rather than wait for input.
+func promptMissingParams(items []ConcatItem, outputFile string, parameters, baseParameters map[string]string) error {
+	var missing []string
+	seen := make(map[string]bool)
+	findMissing := func(value string) error {
+		for _, match := range paramReference.FindAllStringSubmatch(substituteParams(value, parameters), -1) {
+			name := match[2]
+			if _, ok := parameters[name]; ok || match[1] != "" || seen[name] {
+				continue
 			}
+			seen[name] = true
+			missing = append(missing, name)
 		}
+		return nil
+	}
+	if substitutePaths {
+		findMissing(outputFile)
+	}
+	for _, item := range items {
+		if (isPathItem(item) && !substitutePaths) || item.IsResolved {
+			continue
+		}
+		if !item.IsTempFile {
+			findMissing(item.Value)
+		} else if err := eachTempFileLine(item.Value, findMissing); err != nil {
+			return fmt.Errorf("reading text block from %s: %v", item.Value, err)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
 	}
 
-	if operator == "" {
-		return false, fmt.Errorf("invalid condition format: %s", condition)
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("parameter %s is not set (stdin is not a terminal, so --prompt-missing cannot ask for it)", missing[0])
+	}
+	for _, name := range missing {
+		fmt.Fprintf(os.Stderr, "Value for %s: ", name)
+		value, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return fmt.Errorf("reading parameter %s from the terminal: %v", name, err)
+		}
+		parameters[name] = string(value)
+		baseParameters[name] = string(value)
 	}
+	return nil
+}
 
-	actualValue, ok := parameters[key]
-	if !ok {
-		return false, nil // Key not found, condition is false
+// unresolvedReference matches a ${...} reference, or with a leading "$", an escaped one.
+var unresolvedReference = regexp.MustCompile(`(\$?)\$\{[^}]*\}`)
+
+// unresolvedReferences returns a line "where: ${...}" for each reference that
+// substitution left in value, for --report-unresolved. Escaped references are not
+// reported.
+func unresolvedReferences(where string, value string) []string {
+	var lines []string
+	for _, match := range unresolvedReference.FindAllStringSubmatch(value, -1) {
+		if match[1] == "" {
+			lines = append(lines, where+": "+match[0])
+		}
 	}
+	return lines
+}
 
-	if operator == "=" {
-		return actualValue == expectedValue, nil
+// itemKind names the kind of an item in reports, as in the manifest.
+func itemKind(item ConcatItem) string {
+	switch {
+	case item.IsWriteTo:
+		return "write-to"
+	case item.IsZip:
+		return "zip"
+	case item.IsBase64:
+		return "base64"
+	case item.IsTemplate:
+		return "template"
+	case item.IsLiteral:
+		return "sql-literal"
+	case item.IsFile:
+		return "file"
+	case item.IsTime:
+		return "timestamp"
+	}
+	return "text"
+}
+
+// writeLines writes lines to filename, each followed by a newline.
+func writeLines(filename string, lines []string) error {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line + "\n")
 	}
+	return os.WriteFile(filename, []byte(b.String()), 0644)
+}
 
-	// For numerical comparisons
-	actualNum, err1 := strconv.ParseFloat(actualValue, 64)
-	expectedNum, err2 := strconv.ParseFloat(expectedValue, 64)
+// resetRunState clears the state that processing instructions builds up, so that
+// each run starts afresh.
+func resetRunState() {
+	lazyParams = make(map[string]bool)
+	referencedFiles = nil
+	includedFiles = make(map[string]bool)
+	includeDepth = 0
+	includeChain = nil
+	includeEdges = nil
+	replacements = nil
+	indexErr = nil
+	keptErrors = nil
+	pendingOutputs = nil
+	sections = make(map[string]section)
+	tempFiles = nil
+}
 
-	if err1 != nil || err2 != nil {
-		return false, nil // One of the values is not a number, so comparison is false
+// removeTempFiles removes the temporary files of the run.
+func removeTempFiles() {
+	for _, file := range tempFiles {
+		os.Remove(file)
 	}
+	tempFiles = nil
+}
 
-	switch operator {
-	case ">":
-		return actualNum > expectedNum, nil
-	case ">=":
-		return actualNum >= expectedNum, nil
-	case "<":
-		return actualNum < expectedNum, nil
-	case "<=":
-		return actualNum <= expectedNum, nil
+// generate processes the instructions and writes the output once, working on a copy
+// of parameters so that it can be repeated by --watch. The returned error completes
+// the sentence "Error ...", as printed by main.
+func generate(instructionsFile string, instructionsDir string, baseParameters map[string]string) error {
+	parameters := make(map[string]string, len(baseParameters))
+	for name, value := range baseParameters {
+		parameters[name] = value
 	}
+	resetRunState()
+	defer removeTempFiles()
 
-	return false, fmt.Errorf("unhandled operator: %s", operator)
-}
+	var dslOutputFile string
+	var itemsToConcat []ConcatItem
 
-func handleConditionalCommand(command, args string, parameters map[string]string, ifStk *ifStack, skip *bool) error {
-	switch command {
-	case "if":
-		if *skip { // If already skipping, push false to stack and continue skipping
-			ifStk.push(false)
-			return nil
+	err := processInstructions(instructionsFile, &dslOutputFile, &itemsToConcat, parameters, instructionsDir)
+	if err != nil {
+		return instructionsError(err)
+	}
+	if graphFile != "" {
+		if err := writeIncludeGraph(graphFile, instructionsFile); err != nil {
+			return &exitCodeError{code: exitIO, err: fmt.Errorf("writing include graph %s: %w", graphFile, err)}
 		}
-		conditionTrue, err := evaluateCondition(args, parameters)
-		if err != nil {
-			return err
+	}
+
+	if err := resolveLazyParams(parameters); err != nil {
+		return instructionsError(err)
+	}
+
+	if promptMissing {
+		if err := promptMissingParams(itemsToConcat, dslOutputFile, parameters, baseParameters); err != nil {
+			return err
+		}
+	}
+
+	// Re-substitute now that all parameters are finalized, then collapse escaped references.
+	// The references still left before the escapes are collapsed are unresolved.
+	var unresolved []string
+	finalize := func(where string, value string, substitute func(string, map[string]string) string) string {
+		value = substitute(value, parameters)
+		if unresolvedFile != "" {
+			unresolved = append(unresolved, unresolvedReferences(where, value)...)
+		}
+		return unescapeDollars(value)
+	}
+	if dslOutputFile != "" {
+		dslOutputFile = finalize("output", dslOutputFile, substitutePath)
+	}
+	for i := range itemsToConcat {
+		item := &itemsToConcat[i]
+		where := fmt.Sprintf("item %d (%s)", i+1, itemKind(*item))
+		switch {
+		case item.IsResolved:
+			continue
+		case item.IsTempFile:
+			err := rewriteTempFile(item.Value, func(line string) string {
+				return finalize(where, line, substituteParams)
+			})
+			if err != nil {
+				return err
+			}
+		case isPathItem(*item):
+			item.Value = finalize(where, item.Value, substitutePath)
+		default:
+			item.Value = finalize(where, item.Value, substituteParams)
+		}
+	}
+	if unresolvedFile != "" {
+		if err := writeLines(unresolvedFile, unresolved); err != nil {
+			return &exitCodeError{code: exitIO, err: fmt.Errorf("writing unresolved references to %s: %w", unresolvedFile, err)}
+		}
+	}
+	if err := applyReplacements(itemsToConcat, parameters); err != nil {
+		return err
+	}
+	if indexErr != nil {
+		return instructionsError(indexErr)
+	}
+	if err := checkInputItems(itemsToConcat); err != nil {
+		return instructionsError(err)
+	}
+	if keepGoing {
+		if err := reportKeptErrors(itemsToConcat); err != nil {
+			return err
+		}
+	}
+
+	if validateOnly {
+		if err := validateItems(itemsToConcat); err != nil {
+			return &exitCodeError{code: exitIO, err: fmt.Errorf("validating: %w", err)}
+		}
+		if !quietMode {
+			fmt.Fprintf(os.Stdout, "Instructions are valid.\n")
+		}
+		return nil
+	}
+
+	if concatOrder == "reverse" {
+		reverseItems(itemsToConcat)
+	}
+
+	finalOutputFile := outputFlag
+	if dslOutputFile != "" {
+		finalOutputFile = dslOutputFile // DSL 'output' command overrides command-line flag
+	}
+
+	if diffMode {
+		if finalOutputFile == "" {
+			return fmt.Errorf("--diff requires an output file, from --output or the output command")
+		}
+		return diffOutput(resolveOutputPath(finalOutputFile), itemsToConcat, parameters)
+	}
+
+	var outputWriter io.Writer
+	if finalOutputFile == "" {
+		outputWriter = os.Stdout
+	} else {
+		finalOutputFile = resolveOutputPath(finalOutputFile)
+		outFile, err := createOutputFile(finalOutputFile)
+		if err != nil {
+			return &exitCodeError{code: exitIO, err: fmt.Errorf("creating output file %s: %w", finalOutputFile, err)}
+		}
+		defer outFile.Close()
+		outputWriter = outFile
+	}
+
+	var manifest []ManifestEntry
+	err = runConcat(outputWriter, itemsToConcat, parameters, &manifest)
+	if outFile, ok := outputWriter.(*os.File); ok && outFile != os.Stdout {
+		// Closed before the rename, which Windows does not allow for open files
+		if closeErr := outFile.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("error closing output file %s: %v", finalOutputFile, closeErr)
+		}
+	}
+	if err != nil {
+		discardPendingOutputs()
+	} else if err := commitPendingOutputs(); err != nil {
+		return &exitCodeError{code: exitIO, err: err}
+	}
+	if errors.Is(err, errNoOutput) || errors.Is(err, errOutputTooLarge) {
+		return fmt.Errorf("during concatenation: %w", err)
+	}
+	if err != nil {
+		return &exitCodeError{code: exitIO, err: fmt.Errorf("during concatenation: %w", err)}
+	}
+
+	// Applied after --atomic has renamed the file into place
+	if preservePerms && finalOutputFile != "" {
+		if err := copyFirstSourceMode(finalOutputFile, itemsToConcat); err != nil {
+			return &exitCodeError{code: exitIO, err: fmt.Errorf("preserving permissions on %s: %w", finalOutputFile, err)}
+		}
+	}
+
+	if manifestFile != "" {
+		if err := writeManifest(manifestFile, manifest); err != nil {
+			return &exitCodeError{code: exitIO, err: fmt.Errorf("writing manifest %s: %w", manifestFile, err)}
+		}
+	}
+
+	if dumpParams != "" {
+		if err := writeParamsFile(dumpParams, parameters); err != nil {
+			return &exitCodeError{code: exitIO, err: fmt.Errorf("writing parameters to %s: %w", dumpParams, err)}
+		}
+	}
+	return nil
+}
+
+// writeParamsFile writes the parameters, sorted by key, in the --param-file format.
+// Builtin parameters are left out, as a parameter file cannot set them.
+func writeParamsFile(filename string, parameters map[string]string) error {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		if !builtinNames[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var lines strings.Builder
+	for _, name := range names {
+		value := parameters[name]
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("value of parameter %s contains a line break", name)
+		}
+		fmt.Fprintf(&lines, "%s=%s\n", name, value)
+	}
+	return os.WriteFile(filename, []byte(lines.String()), 0666)
+}
+
+// watchAndRegenerate runs generate, then again whenever one of the files used by the
+// last successful run changes, until the process is stopped. Errors are reported
+// without exiting.
+func watchAndRegenerate(instructionsFile string, instructionsDir string, parameters map[string]string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		printError("Error starting file watcher: %v\n", err)
+		os.Exit(1)
+	}
+	defer watcher.Close()
+
+	watched := make(map[string]bool) // Absolute paths of the files that trigger a rebuild
+	watchedDirs := make(map[string]bool)
+	for {
+		addBuiltinParams(parameters, time.Now())
+		if err := generate(instructionsFile, instructionsDir, parameters); err != nil {
+			printError("[%s] Error %v\n", time.Now().Format("15:04:05"), err)
+		} else {
+			if !quietMode {
+				printInfo("[%s] Regenerated from %s\n", time.Now().Format("15:04:05"), instructionsFile)
+			}
+			watched = make(map[string]bool)
+		}
+		// After a failed run, the files of the last successful run are still watched.
+		for _, file := range append(referencedFiles, instructionsFile) {
+			absPath, err := filepath.Abs(file)
+			if err != nil {
+				continue
+			}
+			watched[absPath] = true
+			// Directories are watched rather than the files, so that editors that
+			// replace a file on save are noticed too.
+			dir := filepath.Dir(absPath)
+			if !watchedDirs[dir] {
+				if err := watcher.Add(dir); err != nil {
+					printError("Error watching %s: %v\n", dir, err)
+					continue
+				}
+				watchedDirs[dir] = true
+			}
+		}
+
+		if !waitForChange(watcher, watched) {
+			return
+		}
+	}
+}
+
+// waitForChange blocks until a watched file changes, then waits for the burst of
+// events that a single save often produces to settle. It returns false if the
+// watcher was closed.
+func waitForChange(watcher *fsnotify.Watcher, watched map[string]bool) bool {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return false
+			}
+			if !watched[event.Name] || event.Op == fsnotify.Chmod {
+				continue
+			}
+			settle := time.After(watchSettleDelay)
+			for {
+				select {
+				case _, ok := <-watcher.Events:
+					if !ok {
+						return false
+					}
+				case <-settle:
+					return true
+				}
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return false
+			}
+			printError("Error watching files: %v\n", err)
+		}
+	}
+}
+
+// ANSI escape sequences used to colorize diagnostics.
+const (
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// isTerminal reports whether f is a terminal rather than a file or pipe.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// printColored writes a diagnostic line to stderr, in the given color if --color
+// allows it. The color is reset before the final newline. With --log-format json,
+// it is written by logJSON instead, at the given level.
+func printColored(color string, level string, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	if logFormat == "json" {
+		logJSON(level, message, errorLocation(args))
+		return
+	}
+	if useColor && color != "" {
+		message = color + strings.TrimSuffix(message, "\n") + colorReset + "\n"
+	}
+	fmt.Fprint(os.Stderr, message)
+}
+
+func printError(format string, args ...interface{}) {
+	printColored(colorRed, "error", format, args...)
+}
+
+// printWarning reports a warning on stderr, unless --quiet is given.
+func printWarning(format string, args ...interface{}) {
+	if quietMode {
+		return
+	}
+	printColored(colorYellow, "warn", format, args...)
+}
+
+// printInfo reports progress, such as a --watch rebuild, on stderr without color.
+func printInfo(format string, args ...interface{}) {
+	printColored("", "info", format, args...)
+}
+
+// logJSON writes a diagnostic to stderr for --log-format json, as a JSON object on
+// one line with the level, the message and any further fields. The message loses its
+// final newline and an "Error"/"Warning:" label, which the level replaces.
+func logJSON(level string, message string, fields map[string]interface{}) {
+	message = strings.TrimSuffix(message, "\n")
+	for _, label := range []string{"Error: ", "Error ", "Warning: "} {
+		if trimmed, ok := strings.CutPrefix(message, label); ok {
+			message = trimmed
+			break
+		}
+	}
+	record := map[string]interface{}{"level": level, "msg": message}
+	for name, value := range fields {
+		record[name] = value
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf) // Ends the object with a newline
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(record); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", level, message)
+		return
+	}
+	os.Stderr.Write(buf.Bytes())
+}
+
+// errorLocation returns the file and line of the first DSLError among args, as
+// fields for logJSON, or nil if there is none.
+func errorLocation(args []interface{}) map[string]interface{} {
+	for _, arg := range args {
+		var dslErr *DSLError
+		if err, ok := arg.(error); ok && errors.As(err, &dslErr) && dslErr.File != "" {
+			fields := map[string]interface{}{"file": dslErr.File}
+			if dslErr.Line > 0 {
+				fields["line"] = dslErr.Line
+			}
+			return fields
+		}
+	}
+	return nil
+}
+
+func loadParamsFromFile(filename string, parameters map[string]string) error {
+	return loadParamsFromFileIncludes(filename, parameters, nil, false)
+}
+
+// loadParamsFromFileIncludes loads a parameter file, processing "@include <file>" lines
+// in place: the included file's parameters are loaded at that point, relative to the
+// including file's directory, so later lines override earlier ones. including lists
+// the files currently being loaded, to catch include cycles. A confined file, loaded
+// by the instructions rather than from the command line, and the files it includes
+// must be inside --input-root.
+func loadParamsFromFileIncludes(filename string, parameters map[string]string, including []string, confined bool) error {
+	if confined {
+		if err := checkInputPath(filename); err != nil {
+			return err
+		}
+	}
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return fmt.Errorf("error resolving absolute path for %s: %v", filename, err)
+	}
+	for _, parent := range including {
+		if parent == absPath {
+			return fmt.Errorf("parameter file %s includes itself", filename)
+		}
+	}
+	including = append(including, absPath)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening parameter file %s: %w", filename, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, commentChar) {
+			continue
+		}
+		if includePath, ok := strings.CutPrefix(line, "@include "); ok {
+			includePath = strings.TrimSpace(includePath)
+			if !filepath.IsAbs(includePath) {
+				includePath = filepath.Join(filepath.Dir(filename), includePath)
+			}
+			if err := loadParamsFromFileIncludes(includePath, parameters, including, confined); err != nil {
+				return err
+			}
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			if err := checkNotBuiltin(parts[0]); err != nil {
+				return err
+			}
+			value := parts[1]
+			if paramFileSub {
+				value = substituteParams(value, parameters)
+			}
+			parameters[parts[0]] = value
+		} else {
+			return fmt.Errorf("invalid parameter file line format: %s", line)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadParamsFromDotenv loads a .env file. Unlike a parameter file, lines may start
+// with "export ", values may be wrapped in double or single quotes, and a '#' after
+// whitespace starts a comment.
+func loadParamsFromDotenv(filename string, parameters map[string]string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening .env file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid .env line format: %s", line)
+		}
+		key := strings.TrimSpace(parts[0])
+		value, err := parseDotenvValue(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", key, err)
+		}
+		if err := checkNotBuiltin(key); err != nil {
+			return err
+		}
+		parameters[key] = value
+	}
+	return scanner.Err()
+}
+
+// parseDotenvValue unquotes a .env value and drops a trailing comment. Double-quoted
+// values support the \n, \", and \\ escapes; single-quoted values are taken literally.
+func parseDotenvValue(raw string) (string, error) {
+	if raw == "" || (raw[0] != '"' && raw[0] != '\'') {
+		if i := strings.Index(raw, " #"); i >= 0 {
+			raw = raw[:i]
+		}
+		if i := strings.Index(raw, "\t#"); i >= 0 {
+			raw = raw[:i]
+		}
+		return strings.TrimSpace(raw), nil
+	}
+
+	quote := raw[0]
+	var value strings.Builder
+	for i := 1; i < len(raw); i++ {
+		c := raw[i]
+		if quote == '"' && c == '\\' && i+1 < len(raw) {
+			i++
+			switch raw[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case '"', '\\':
+				value.WriteByte(raw[i])
+			default:
+				value.WriteByte('\\')
+				value.WriteByte(raw[i])
+			}
+			continue
+		}
+		if c == quote {
+			rest := strings.TrimSpace(raw[i+1:])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return "", fmt.Errorf("unexpected text after closing quote: %s", rest)
+			}
+			return value.String(), nil
+		}
+		value.WriteByte(c)
+	}
+	return "", fmt.Errorf("missing closing quote")
+}
+
+// loadParamsFromEnv imports the variables in environ (KEY=value entries) whose names
+// start with prefix, removing the prefix from the parameter names.
+func loadParamsFromEnv(environ []string, prefix string, parameters map[string]string) error {
+	for _, entry := range environ {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], prefix) || parts[0] == prefix {
+			continue
+		}
+		name := strings.TrimPrefix(parts[0], prefix)
+		if err := checkNotBuiltin(name); err != nil {
+			return err
+		}
+		parameters[name] = parts[1]
+	}
+	return nil
+}
+
+// loadParamsFromStdin reads one line from r for each name, in order, and stores it
+// as a CLI-level parameter.
+func loadParamsFromStdin(r io.Reader, names []string, parameters map[string]string) error {
+	reader := bufio.NewReader(r)
+	for _, name := range names {
+		if err := checkNotBuiltin(name); err != nil {
+			return err
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			if err == io.EOF {
+				return fmt.Errorf("no value provided for parameter %s", name)
+			}
+			return err
+		}
+		parameters[name] = strings.TrimRight(line, "\r\n")
+		cliParamsSet[name] = true
+	}
+	return nil
+}
+
+// loadParamsFromFiles handles --define-from-file KEY=path: each parameter is set to the
+// whole contents of a file, with a single trailing "\n" or "\r\n" removed so that a
+// value saved by an editor does not end in a line break.
+func loadParamsFromFiles(definitions []string, parameters map[string]string) error {
+	for _, definition := range definitions {
+		name, path, ok := strings.Cut(definition, "=")
+		if !ok || name == "" || path == "" {
+			return fmt.Errorf("expected KEY=path, got: %s", definition)
+		}
+		if err := checkNotBuiltin(name); err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		value := strings.TrimSuffix(string(content), "\n")
+		parameters[name] = strings.TrimSuffix(value, "\r")
+		cliParamsSet[name] = true
+	}
+	return nil
+}
+
+// applyConfigFile sets flag values from a config file of flagname=value lines.
+// Flags given on the command line take precedence; config entries for them are ignored.
+// Repeatable flags such as param may appear on several lines.
+func applyConfigFile(filename string) error {
+	if filename == "" {
+		filename = defaultConfigFile
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return nil
+		}
+	}
+
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("error opening config file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid config file line format: %s", line)
+		}
+		name := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if name == "config" || flag.Lookup(name) == nil {
+			return fmt.Errorf("unknown option in config file %s: %s", filename, name)
+		}
+		if setOnCommandLine[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value for %s in config file %s: %v", name, filename, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// addBuiltinParams injects the read-only builtin parameters derived from now.
+func addBuiltinParams(parameters map[string]string, now time.Time) {
+	builtins := map[string]string{
+		"__TIMESTAMP__": now.Format(timestampFmt),
+		"__DATE__":      now.Format("2006-01-02"),
+		"__UNIX__":      strconv.FormatInt(now.Unix(), 10),
+		"__OS__":        runtime.GOOS,
+		"__ARCH__":      runtime.GOARCH,
+		"__PROFILE__":   profile,
+	}
+	for name, value := range builtins {
+		parameters[name] = value
+		builtinNames[name] = true
+	}
+	// __FILE__ and __LINE__ are substituted where they are used rather than stored.
+	builtinNames["__FILE__"] = true
+	builtinNames["__LINE__"] = true
+	builtinNames["__ITER__"] = true
+}
+
+// lineContext describes where an instructions line comes from. It backs the
+// ${__FILE__}, ${__LINE__} and ${__ITER__} builtins.
+type lineContext struct {
+	file      string
+	line      int
+	iteration string // Iteration number of the innermost repeat block, if any
+	inSection bool   // Lines come from use-section; parameters are substituted as each line is processed
+}
+
+// substituteLocation replaces ${__FILE__}, ${__LINE__} and, inside a repeat block,
+// ${__ITER__} so that they reflect the place where they are used. It scans like
+// substituteParams, so escaped references such as $${__FILE__} are left untouched.
+func substituteLocation(s string, ctx lineContext) string {
+	if !strings.Contains(s, "${__") {
+		return s
+	}
+	location := map[string]string{"__FILE__": ctx.file, "__LINE__": strconv.Itoa(ctx.line)}
+	if ctx.iteration != "" {
+		location["__ITER__"] = ctx.iteration
+	}
+	return substituteParams(s, location)
+}
+
+func checkNotBuiltin(name string) error {
+	if builtinNames[name] {
+		return fmt.Errorf("cannot modify builtin parameter %s", name)
+	}
+	return nil
+}
+
+type stringArray []string
+
+func (i *stringArray) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *stringArray) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+// substituteParams replaces each ${KEY} with the value of parameter KEY, and the
+// ${KEY[n]}, ${KEY:offset} and ${KEY:%05d} forms with part of it. The string is
+// scanned once from left to right, and substituted values are not scanned again, so a
+// value cannot form or escape a reference with the text around it. An escaped
+// reference, $${KEY}, is left untouched so that it survives every substitution pass;
+// unescapeDollars collapses it to a literal ${KEY} when the output is written.
+func substituteParams(s string, parameters map[string]string) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+	var result strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			result.WriteString(s[:i+2]) // Escaped; the text after it is scanned as usual
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 {
+			break
+		}
+		value, ok := referenceValue(s[i+2:i+2+end], parameters)
+		if !ok {
+			// Left as is, but a reference inside it, as in ${A_${B}}, is still substituted.
+			result.WriteString(s[:i+2])
+			s = s[i+2:]
+			continue
+		}
+		result.WriteString(s[:i])
+		result.WriteString(value)
+		s = s[i+2+end+1:]
+	}
+	result.WriteString(s)
+	return result.String()
+}
+
+// referenceValue returns what the reference ${ref} stands for, or false if it is to
+// be left as is: the value of parameter ref, or for ref KEY[n] or KEY:spec, the part
+// of KEY's value given by indexedValue or substringValue.
+func referenceValue(ref string, parameters map[string]string) (string, bool) {
+	if value, ok := parameters[ref]; ok {
+		return value, true
+	}
+	if key, subscript, ok := strings.Cut(ref, "["); ok && strings.HasSuffix(subscript, "]") {
+		if value, defined := parameters[key]; defined {
+			return indexedValue(key, strings.TrimSuffix(subscript, "]"), value)
+		}
+	}
+	if key, spec, ok := strings.Cut(ref, ":"); ok {
+		if value, defined := parameters[key]; defined {
+			return substringValue(spec, value)
+		}
+	}
+	return "", false
+}
+
+// indexedValue returns, for ${KEY[n]}, the element at 0-based index n of the
+// comma-separated list in value, and for ${KEY[#]}, the number of elements. Elements
+// are trimmed of surrounding spaces, and an empty value has no elements. An index out
+// of range yields "", or with --index-out-of-range error, also records indexErr. A
+// subscript that is not an index yields false.
+func indexedValue(key string, subscript string, value string) (string, bool) {
+	var elements []string
+	if value != "" {
+		elements = strings.Split(value, ",")
+		for i := range elements {
+			elements[i] = strings.TrimSpace(elements[i])
+		}
+	}
+	if subscript == "#" {
+		return strconv.Itoa(len(elements)), true
+	}
+	index, err := strconv.Atoi(subscript)
+	if err != nil {
+		return "", false
+	}
+	if index >= 0 && index < len(elements) {
+		return elements[index], true
+	}
+	if indexOutOfRange == "error" && indexErr == nil {
+		indexErr = fmt.Errorf("index %d out of range for parameter %s with %d elements", index, key, len(elements))
+	}
+	return "", true
+}
+
+// substringValue returns, for ${KEY:offset} and ${KEY:offset:length}, part of value,
+// as in bash: offset counts characters from 0, or from the end if negative, and a
+// negative length stops that many characters before the end. Offsets and lengths
+// beyond the value are clamped to it. ${KEY:%05d} and other printf-style formats are
+// handled by formatValue. Anything else after the colon yields false.
+func substringValue(spec string, value string) (string, bool) {
+	runes := []rune(value)
+	if from, to, ok := parseSubstring(spec, len(runes)); ok {
+		return string(runes[from:to]), true
+	}
+	return formatValue(spec, value)
+}
+
+// formatSpec matches a printf-style format with a single verb, for formatValue.
+var formatSpec = regexp.MustCompile(`^%[-+ #0]*[0-9]*(\.[0-9]+)?[dxXobeEfgGs]$`)
+
+// formatValue formats value with spec, such as %05d or %.2f. The integer verbs (d, x,
+// X, o and b) need a decimal integer value and the others, except s, any number. A
+// value that is not such a number, like an invalid spec, yields false, and the
+// reference is left as is.
+func formatValue(spec string, value string) (string, bool) {
+	if !formatSpec.MatchString(spec) {
+		return "", false
+	}
+	switch spec[len(spec)-1] {
+	case 's':
+		return fmt.Sprintf(spec, value), true
+	case 'd', 'x', 'X', 'o', 'b':
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf(spec, n), true
+	default:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf(spec, f), true
+	}
+}
+
+// parseSubstring parses "offset" or "offset:length" for substringValue into
+// the bounds of the substring of a value of n characters.
+func parseSubstring(spec string, n int) (int, int, bool) {
+	offsetSpec, lengthSpec, hasLength := strings.Cut(spec, ":")
+	offset, err := strconv.Atoi(strings.TrimSpace(offsetSpec))
+	if err != nil {
+		return 0, 0, false
+	}
+	clamp := func(i int) int {
+		if i < 0 {
+			i += n
+		}
+		return min(max(i, 0), n)
+	}
+	from, to := clamp(offset), n
+	if hasLength {
+		length, err := strconv.Atoi(strings.TrimSpace(lengthSpec))
+		if err != nil {
+			return 0, 0, false
+		}
+		if length < 0 {
+			to = clamp(length)
+		} else {
+			to = min(from+length, n)
+		}
+	}
+	return from, max(from, to), true
+}
+
+// pathCommands are the commands whose arguments are, or contain, a file path, which
+// --substitute-file-names=false leaves unsubstituted.
+var pathCommands = map[string]bool{
+	"output": true, "write-to": true, "concat": true, "concat-template": true, "concat-zip": true,
+	"emit-base64": true, "concat-dir": true, "concat-tree": true, "if-file-exists": true,
+	"if-file-nonempty": true, "count": true, "set-from-json": true, "chdir": true, "param-file-if": true,
+	"concat-sql-literal": true, "include": true, "include-if-exists": true, "include-once": true, "include-glob": true,
+}
+
+// substitutePath substitutes parameters in a file path, unless
+// --substitute-file-names=false keeps paths literal, so that a parameter cannot
+// redirect which files are read or written.
+func substitutePath(path string, parameters map[string]string) string {
+	if !substitutePaths {
+		return path
+	}
+	return substituteParams(path, parameters)
+}
+
+// isPathItem reports whether the value of item is a path, for substitutePath.
+func isPathItem(item ConcatItem) bool {
+	return item.IsFile || item.IsZip || item.IsWriteTo
+}
+
+// resolveInputPath returns path as a clean absolute path, with symbolic links
+// resolved if it exists, so that it can be compared with --input-root.
+func resolveInputPath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(absPath); err == nil {
+		return resolved, nil
+	}
+	return absPath, nil
+}
+
+// checkInputPath returns an error if --input-root is given and path, once made
+// absolute and cleaned, with symbolic links resolved, is outside it. Paths that do
+// not exist are compared as written, as reading them fails anyway.
+func checkInputPath(path string) error {
+	if inputRoot == "" {
+		return nil
+	}
+	resolved, err := resolveInputPath(path)
+	if err != nil {
+		return fmt.Errorf("error resolving absolute path for %s: %v", path, err)
+	}
+	rel, err := filepath.Rel(inputRoot, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside the input root %s", path, inputRoot)
+	}
+	return nil
+}
+
+// checkInputItems applies checkInputPath to the files that the items read, once
+// their paths are final. write-to files are written, not read, so they are not
+// checked.
+func checkInputItems(items []ConcatItem) error {
+	for _, item := range items {
+		if !item.IsFile && !item.IsZip {
+			continue
+		}
+		path := item.Value
+		if item.IsZip {
+			path, _, _ = splitZipPath(path)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(item.BaseDir, path)
+		}
+		if err := checkInputPath(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unescapeDollars turns each escaped reference $${ into a literal ${.
+func unescapeDollars(s string) string {
+	return strings.ReplaceAll(s, "$${", "${")
+}
+
+func unescapeString(s string) string {
+	s = strings.ReplaceAll(s, "@@n", "\n")
+	s = strings.ReplaceAll(s, "@@r", "\r")
+	s = strings.ReplaceAll(s, "@@t", "\t")
+	s = strings.ReplaceAll(s, "@@s", " ")
+	s = strings.ReplaceAll(s, "@@0", "\x00")
+	return s
+}
+
+// stripTrailingComment removes a trailing " #..." comment from a command line. The
+// '#' only starts a comment when it follows whitespace and is outside a quoted value;
+// "\#" yields a literal '#' that never starts a comment. The --comment-char only
+// marks whole-line comments, as it may well appear in emitted SQL, like ';'.
+func stripTrailingComment(line string) string {
+	const comment = '#'
+	var result strings.Builder
+	var quote rune
+	prevSpace := true
+	runes := []rune(line)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes) && runes[i+1] == comment:
+			result.WriteRune(comment)
+			i++
+			prevSpace = false
+			continue
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case (r == '"' || r == '\'') && prevSpace:
+			quote = r
+		case r == comment && prevSpace:
+			return strings.TrimRightFunc(result.String(), unicode.IsSpace)
+		}
+		result.WriteRune(r)
+		prevSpace = unicode.IsSpace(r)
+	}
+	return result.String()
+}
+
+// unquoteArgs removes shell-style quoting from command arguments. When the whole
+// argument is a single quoted token, e.g. "dir with spaces/file.sql" or 'a b c', the
+// surrounding quotes are dropped and an escaped quote character or "\\" inside is
+// unescaped. Anything else is returned unchanged so that SQL literals such as
+// name = 'bob' keep their quotes.
+func unquoteArgs(args string) string {
+	if len(args) < 2 || (args[0] != '"' && args[0] != '\'') {
+		return args
+	}
+	quote := args[0]
+	var result strings.Builder
+	for i := 1; i < len(args); i++ {
+		c := args[i]
+		if c == '\\' && i+1 < len(args) && (args[i+1] == quote || args[i+1] == '\\') {
+			result.WriteByte(args[i+1])
+			i++
+		} else if c == quote {
+			if i != len(args)-1 {
+				break // The quoted token does not span the whole argument
+			}
+			return result.String()
+		} else {
+			result.WriteByte(c)
+		}
+	}
+	return args
+}
+
+// cutQuotedToken splits args that start with a quoted token, as unquoteArgs reads
+// it, into the unquoted token and the rest after its closing quote. It returns false
+// if args does not start with a quote, or the token is not closed or is followed by
+// anything but whitespace.
+func cutQuotedToken(args string) (string, string, bool) {
+	if len(args) < 2 || (args[0] != '"' && args[0] != '\'') {
+		return "", "", false
+	}
+	quote := args[0]
+	for i := 1; i < len(args); i++ {
+		if args[i] == '\\' && i+1 < len(args) && (args[i+1] == quote || args[i+1] == '\\') {
+			i++
+		} else if args[i] == quote {
+			if i+1 < len(args) && args[i+1] != ' ' && args[i+1] != '\t' {
+				return "", "", false
+			}
+			return unquoteArgs(args[:i+1]), args[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// textBlockOptions holds the options given on a text-begin line.
+type textBlockOptions struct {
+	trim   bool   // Trim trailing whitespace from each line and collapse runs of blank lines
+	chomp  bool   // Drop the newline after the last line of the block
+	indent int    // Number of spaces prepended to each non-empty line
+	end    string // The line that ends the block: text-end, or the delimiter given as in text-begin EOF
+}
+
+func parseTextBlockOptions(args string) (textBlockOptions, error) {
+	opts := textBlockOptions{end: "text-end"}
+	for _, option := range strings.Fields(args) {
+		switch option {
+		case "trim":
+			opts.trim = true
+		case "chomp":
+			opts.chomp = true
+		default:
+			if value, ok := strings.CutPrefix(option, "indent="); ok {
+				indent, err := strconv.Atoi(value)
+				if err != nil || indent < 0 {
+					return opts, fmt.Errorf("invalid text-begin indent: %s", value)
+				}
+				opts.indent = indent
+				continue
+			}
+			// Any other word is the delimiter, like the word after << in a shell here-doc
+			if strings.Contains(option, "=") {
+				return opts, fmt.Errorf("unknown text-begin option: %s", option)
+			}
+			if opts.end != "text-end" {
+				return opts, fmt.Errorf("text-begin has more than one delimiter: %s and %s", opts.end, option)
+			}
+			opts.end = option
+		}
+	}
+	return opts, nil
+}
+
+// textBlockEnd returns the line that ends the text block begun by a text-begin line.
+// Invalid options are reported when the line is dispatched; until then the block
+// is taken to end at text-end.
+func textBlockEnd(line string, prefix string) string {
+	commandLine := strings.TrimSpace(stripTrailingComment(strings.TrimSpace(line)))
+	if prefix != "" {
+		commandLine = strings.TrimPrefix(commandLine, prefix+":")
+	}
+	opts, err := parseTextBlockOptions(strings.TrimPrefix(commandLine, "text-begin"))
+	if err != nil {
+		return "text-end"
+	}
+	return opts.end
+}
+
+// formatTextBlock joins the captured lines of a text block, applying its options.
+func formatTextBlock(lines []string, opts textBlockOptions) string {
+	var textBlock strings.Builder
+	writeTextBlock(&textBlock, lines, opts)
+	return textBlock.String()
+}
+
+// writeTextBlock writes the captured lines of a text block to w, applying its
+// options. Write errors are left for w to report, as bufio.Writer does on Flush.
+func writeTextBlock(w io.StringWriter, lines []string, opts textBlockOptions) {
+	prevBlank := false
+	newlinePending := false
+	for _, line := range lines {
+		if opts.trim {
+			line = strings.TrimRightFunc(line, unicode.IsSpace)
+			if line == "" && prevBlank {
+				continue
+			}
+			prevBlank = line == ""
+		}
+		if opts.indent > 0 && line != "" {
+			line = strings.Repeat(" ", opts.indent) + line
+		}
+		if newlinePending {
+			w.WriteString("\n")
+		}
+		w.WriteString(line)
+		newlinePending = true
+	}
+	if newlinePending && !opts.chomp {
+		w.WriteString("\n")
+	}
+}
+
+// textBlockItem returns the item for a text block. With --text-spill-size, a block
+// larger than the limit is written to a temporary file, which is then processed line
+// by line, so that the final substitution and replace need not copy it in memory.
+func textBlockItem(lines []string, opts textBlockOptions) (ConcatItem, error) {
+	size := 0
+	for _, line := range lines {
+		size += len(line) + 1 + opts.indent
+	}
+	if textSpillSize == 0 || size <= textSpillSize {
+		return ConcatItem{Value: formatTextBlock(lines, opts)}, nil
+	}
+	file, err := os.CreateTemp("", "db-concat-text-*")
+	if err != nil {
+		return ConcatItem{}, fmt.Errorf("error creating temporary file for text block: %v", err)
+	}
+	tempFiles = append(tempFiles, file.Name())
+	w := bufio.NewWriter(file)
+	writeTextBlock(w, lines, opts)
+	err = w.Flush()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ConcatItem{}, fmt.Errorf("error writing text block to %s: %v", file.Name(), err)
+	}
+	return ConcatItem{IsTempFile: true, Value: file.Name()}, nil
+}
+
+// eachTempFileLine calls fn with each line, including its "\n", of a temporary text
+// block file, stopping at the first error.
+func eachTempFileLine(path string, fn func(line string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if line != "" {
+			if err := fn(line); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// rewriteTempFile replaces each line of a temporary text block file by edit(line).
+func rewriteTempFile(path string, edit func(line string) string) error {
+	out, err := os.CreateTemp(filepath.Dir(path), "db-concat-text-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file: %v", err)
+	}
+	tempFiles = append(tempFiles, out.Name())
+	w := bufio.NewWriter(out)
+	err = eachTempFileLine(path, func(line string) error {
+		_, err := w.WriteString(edit(line))
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), path)
+	}
+	if err != nil {
+		return fmt.Errorf("error rewriting temporary file %s: %v", path, err)
+	}
+	return nil
+}
+
+type ifStack []bool
+
+func (s *ifStack) push(val bool) {
+	*s = append(*s, val)
+}
+
+func (s *ifStack) pop() (bool, error) {
+	if len(*s) == 0 {
+		return false, fmt.Errorf("pop on empty stack")
+	}
+	val := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return val, nil
+}
+
+func (s *ifStack) peek() (bool, error) {
+	if len(*s) == 0 {
+		return false, fmt.Errorf("peek on empty stack")
+	}
+	return (*s)[len(*s)-1], nil
+}
+
+// evaluateCondition evaluates an if condition. A condition is a single comparison such
+// as KEY=VALUE, or comparisons combined with &&, || and parentheses, where && binds
+// more tightly than ||.
+func evaluateCondition(condition string, parameters map[string]string) (bool, error) {
+	if !strings.Contains(condition, "&&") && !strings.Contains(condition, "||") && !strings.HasPrefix(strings.TrimSpace(condition), "(") {
+		// A plain comparison is taken as is, so its value may contain spaces or parentheses.
+		return evaluateComparison(condition, parameters)
+	}
+	p := &conditionParser{tokens: tokenizeCondition(condition), condition: condition, parameters: parameters}
+	result, err := p.parseOr()
+	if err != nil {
+		return false, err
+	}
+	if p.pos < len(p.tokens) {
+		if p.tokens[p.pos] == ")" {
+			return false, fmt.Errorf("unbalanced parentheses in condition: %s", condition)
+		}
+		return false, fmt.Errorf("unexpected %q in condition: %s", p.tokens[p.pos], condition)
+	}
+	return result, nil
+}
+
+// tokenizeCondition splits a compound condition into "(", ")", "&&", "||" and the
+// comparisons between them, with surrounding spaces trimmed.
+func tokenizeCondition(condition string) []string {
+	var tokens []string
+	start := 0
+	flush := func(end int) {
+		if text := strings.TrimSpace(condition[start:end]); text != "" {
+			tokens = append(tokens, text)
+		}
+	}
+	for i := 0; i < len(condition); i++ {
+		switch {
+		case condition[i] == '(' || condition[i] == ')':
+			flush(i)
+			tokens = append(tokens, condition[i:i+1])
+			start = i + 1
+		case strings.HasPrefix(condition[i:], "&&") || strings.HasPrefix(condition[i:], "||"):
+			flush(i)
+			tokens = append(tokens, condition[i:i+2])
+			i++
+			start = i + 1
+		}
+	}
+	flush(len(condition))
+	return tokens
+}
+
+// conditionParser is a recursive-descent parser for compound if conditions:
+//
+//	or         = and { "||" and }
+//	and        = operand { "&&" operand }
+//	operand    = "(" or ")" | comparison
+//
+// Every comparison is evaluated, so a malformed one is reported even where the
+// result would not depend on it.
+type conditionParser struct {
+	tokens     []string
+	pos        int
+	condition  string
+	parameters map[string]string
+}
+
+func (p *conditionParser) parseOr() (bool, error) {
+	result, err := p.parseAnd()
+	if err != nil {
+		return false, err
+	}
+	for p.pos < len(p.tokens) && p.tokens[p.pos] == "||" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return false, err
+		}
+		result = result || right
+	}
+	return result, nil
+}
+
+func (p *conditionParser) parseAnd() (bool, error) {
+	result, err := p.parseOperand()
+	if err != nil {
+		return false, err
+	}
+	for p.pos < len(p.tokens) && p.tokens[p.pos] == "&&" {
+		p.pos++
+		right, err := p.parseOperand()
+		if err != nil {
+			return false, err
+		}
+		result = result && right
+	}
+	return result, nil
+}
+
+func (p *conditionParser) parseOperand() (bool, error) {
+	if p.pos >= len(p.tokens) {
+		return false, fmt.Errorf("missing comparison at end of condition: %s", p.condition)
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token {
+	case "(":
+		result, err := p.parseOr()
+		if err != nil {
+			return false, err
+		}
+		if p.pos >= len(p.tokens) || p.tokens[p.pos] != ")" {
+			return false, fmt.Errorf("unbalanced parentheses in condition: %s", p.condition)
+		}
+		p.pos++
+		return result, nil
+	case ")", "&&", "||":
+		return false, fmt.Errorf("missing comparison before %s in condition: %s", token, p.condition)
+	}
+	return evaluateComparison(token, p.parameters)
+}
+
+// evaluateComparison evaluates a single KEY<operator>VALUE comparison, or one of the
+// literals true, false, 1 and 0.
+func evaluateComparison(condition string, parameters map[string]string) (bool, error) {
+	switch strings.TrimSpace(condition) {
+	case "true", "1":
+		return true, nil
+	case "false", "0":
+		return false, nil
+	}
+	// The condition is split at its first operator, so that the value may contain
+	// operators of its own (e.g. A=x>=y). At that position longer operators come
+	// first, so that e.g. ">>=" is not mistaken for ">=".
+	operators := []string{">>=", "<<=", ">>", "<<", ">=", "<=", "=", ">", "<"}
+	var operator, key, expectedValue string
+
+	if i := strings.IndexAny(condition, "=<>"); i >= 0 {
+		for _, op := range operators {
+			if strings.HasPrefix(condition[i:], op) {
+				operator = op
+				key = condition[:i]
+				expectedValue = condition[i+len(op):]
+				break
+			}
+		}
+	}
+
+	if operator == "" {
+		return false, fmt.Errorf("invalid condition format: %s", condition)
+	}
+
+	actualValue, ok := parameters[key]
+	if !ok {
+		return false, nil // Key not found, condition is false
+	}
+
+	if operator == "=" {
+		return actualValue == expectedValue, nil
+	}
+
+	if strings.HasPrefix(operator, ">>") || strings.HasPrefix(operator, "<<") {
+		return compareVersionCondition(operator, actualValue, expectedValue)
+	}
+
+	// For numerical comparisons
+	actualNum, err1 := strconv.ParseFloat(actualValue, 64)
+	expectedNum, err2 := strconv.ParseFloat(expectedValue, 64)
+
+	if err1 != nil || err2 != nil {
+		return false, nil // One of the values is not a number, so comparison is false
+	}
+
+	switch operator {
+	case ">":
+		return actualNum > expectedNum, nil
+	case ">=":
+		return actualNum >= expectedNum, nil
+	case "<":
+		return actualNum < expectedNum, nil
+	case "<=":
+		return actualNum <= expectedNum, nil
+	}
+
+	return false, fmt.Errorf("unhandled operator: %s", operator)
+}
+
+// parseVersion parses a dotted version string such as 1.10.2 (optionally prefixed
+// with "v") into its numeric segments.
+func parseVersion(version string) ([]int, error) {
+	trimmed := strings.TrimPrefix(version, "v")
+	if trimmed == "" {
+		return nil, fmt.Errorf("invalid version: %q", version)
+	}
+	var segments []int
+	for _, part := range strings.Split(trimmed, ".") {
+		segment, err := strconv.Atoi(part)
+		if err != nil || segment < 0 || strings.HasPrefix(part, "+") {
+			return nil, fmt.Errorf("invalid version: %q", version)
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
+
+// compareVersions returns -1, 0 or 1 as a is lower than, equal to or higher than b.
+// Missing trailing segments count as 0, so 1.2 equals 1.2.0.
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func compareVersionCondition(operator, actualValue, expectedValue string) (bool, error) {
+	actualVersion, err := parseVersion(actualValue)
+	if err != nil {
+		return false, err
+	}
+	expectedVersion, err := parseVersion(expectedValue)
+	if err != nil {
+		return false, err
+	}
+	cmp := compareVersions(actualVersion, expectedVersion)
+	switch operator {
+	case ">>":
+		return cmp > 0, nil
+	case ">>=":
+		return cmp >= 0, nil
+	case "<<":
+		return cmp < 0, nil
+	case "<<=":
+		return cmp <= 0, nil
+	}
+	return false, fmt.Errorf("unhandled operator: %s", operator)
+}
+
+// fileCondition evaluates if-file-exists and if-file-nonempty. A missing file makes
+// if-file-exists false, but is an error for if-file-nonempty unless --on-missing-file
+// skip is given, so that a misspelled path is not mistaken for an empty file.
+func fileCondition(command, args string, parameters map[string]string, baseDir string) (bool, error) {
+	path := substitutePath(unquoteArgs(args), parameters)
+	if path == "" {
+		return false, fmt.Errorf("%s requires a file path", command)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	if err := checkInputPath(path); err != nil {
+		return false, err
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && (command == "if-file-exists" || onMissing == "skip") {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error checking file %s: %w", path, err)
+	}
+	if command == "if-file-nonempty" {
+		return !info.IsDir() && info.Size() > 0, nil
+	}
+	return !info.IsDir(), nil
+}
+
+func handleConditionalCommand(command, args string, parameters map[string]string, baseDir string, ifStk *ifStack, skip *bool) error {
+	switch command {
+	case "if", "if-file-exists", "if-file-nonempty":
+		if *skip { // If already skipping, push false to stack and continue skipping
+			ifStk.push(false)
+			return nil
+		}
+		var conditionTrue bool
+		var err error
+		if command != "if" {
+			conditionTrue, err = fileCondition(command, args, parameters, baseDir)
+		} else {
+			conditionTrue, err = evaluateCondition(args, parameters)
+			if err != nil {
+				err = &DSLError{Kind: DSLErrorCondition, Err: err}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		ifStk.push(conditionTrue)
+		*skip = !conditionTrue
+		return nil
+	case "else":
+		if len(*ifStk) == 0 {
+			return newDSLError(DSLErrorUnmatchedBlock, "else without a preceding if")
+		}
+		prevIfState, err := ifStk.pop()
+		if err != nil {
+			return err
+		}
+		// If the previous 'if' was true, then the 'else' block should be skipped.
+		// If the previous 'if' was false, the 'else' block should be executed,
+		// but only if we are not already skipping due to an outer 'if'.
+		if prevIfState { // Previous 'if' was true, so skip this 'else' block
+			*skip = true
+		} else { // Previous 'if' was false, so execute this 'else' block
+			// Only set skip to false if no outer 'if' is currently skipping
+			if len(*ifStk) > 0 {
+				outerSkipState, err := ifStk.peek()
+				if err != nil {
+					return err
+				}
+				*skip = !outerSkipState // Revert to outer if's skip state
+			} else {
+				*skip = false // No outer if, so execute
+			}
+		}
+		ifStk.push(!prevIfState) // Push the new state for potential nested 'else' or 'endif'
+		return nil
+	case "endif":
+		if len(*ifStk) == 0 {
+			return newDSLError(DSLErrorUnmatchedBlock, "endif without a preceding if")
+		}
+		_, err := ifStk.pop() // Pop from stack
+		if err != nil {
+			return err
+		}
+		if len(*ifStk) > 0 {
+			currentIfState, err := ifStk.peek()
+			if err != nil {
+				return err
+			}
+			*skip = !currentIfState // Revert to parent if's skip state
+		} else {
+			*skip = false // No more if blocks, so no skipping
+		}
+		return nil
+	}
+	return nil
+}
+
+func handleOutputCommand(args string, outputFile *string) error {
+	if lockOutput && includeDepth > 0 {
+		return fmt.Errorf("output %s is not allowed in an included file with --lock-output; only the main instructions file sets the output path", args)
+	}
+	*outputFile = args
+	return nil
+}
+
+// handleChdirCommand handles "chdir DIR", which makes DIR the base directory for
+// the relative paths of the following commands of the current instructions file. A
+// relative DIR is resolved against the current base directory. Included files start
+// from their own directory, and a chdir in one does not affect the file including it.
+func handleChdirCommand(args string, parameters map[string]string, baseDir *string) error {
+	// Later commands resolve their paths against it, so it is substituted now.
+	dir := unescapeDollars(substitutePath(args, parameters))
+	if dir == "" {
+		return fmt.Errorf("chdir requires a directory path")
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(*baseDir, dir)
+	}
+	if err := checkInputPath(dir); err != nil {
+		return err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("error changing to directory %s: %w", dir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("chdir: %s is not a directory", dir)
+	}
+	*baseDir = dir
+	return nil
+}
+
+func handleConcatCommand(args string, itemsToConcat *[]ConcatItem, baseDir string) error {
+	// A quoted path may contain " | ", so the pipe is only looked for after it.
+	quotedPath := ""
+	if _, rest, ok := cutQuotedToken(args); ok {
+		quotedPath, args = args[:len(args)-len(rest)], rest
+	}
+	args, pipeline, err := parsePipeline(args)
+	if err != nil {
+		return err
+	}
+	item, err := parseConcatOptions(strings.TrimSpace(quotedPath + " " + args))
+	if err != nil {
+		return err
+	}
+	item.IsFile, item.BaseDir, item.Pipeline = true, baseDir, pipeline
+	*itemsToConcat = append(*itemsToConcat, item)
+	return nil
+}
+
+// pipeSeparator matches the first "|" of "file | filter | filter". It must stand
+// alone, so that a grep pattern such as a|b is not taken for it.
+var pipeSeparator = regexp.MustCompile(`\s\|(\s|$)`)
+
+// parsePipeline splits "file ... | filter | filter" into the part before the first
+// pipe and the names of the filters, which must be in namedFilters.
+func parsePipeline(args string) (string, []string, error) {
+	loc := pipeSeparator.FindStringIndex(args)
+	if loc == nil {
+		return args, nil, nil
+	}
+	var pipeline []string
+	for _, name := range strings.Split(args[loc[0]+2:], "|") {
+		name = strings.TrimSpace(name)
+		if _, ok := namedFilters[name]; !ok {
+			var names []string
+			for known := range namedFilters {
+				names = append(names, known)
+			}
+			sort.Strings(names)
+			return "", nil, fmt.Errorf("unknown filter: %q (expected one of %s)", name, strings.Join(names, ", "))
+		}
+		pipeline = append(pipeline, name)
+	}
+	return strings.TrimSpace(args[:loc[0]]), pipeline, nil
+}
+
+// concatOption matches the start of the options after the file path of a concat.
+var concatOption = regexp.MustCompile(`\s(grep|head|tail)\s`)
+
+// parseConcatOptions splits "file [head N] [tail N] [grep [-v] pattern ...]" into an
+// item with the file path, which may be quoted, its line range and its line filters.
+// Options are only looked for after a quoted path, so that the path may contain
+// words such as head. Each pattern is a single word; use \s to match spaces.
+func parseConcatOptions(args string) (ConcatItem, error) {
+	path, options, quoted := cutQuotedToken(args)
+	if !quoted {
+		loc := concatOption.FindStringIndex(args)
+		if loc == nil {
+			return ConcatItem{Value: args}, nil
+		}
+		path, options = strings.TrimSpace(args[:loc[0]]), args[loc[0]:]
+	}
+	item := ConcatItem{Value: path}
+
+	fields := strings.Fields(options)
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "head", "tail":
+			if i+1 >= len(fields) {
+				return ConcatItem{}, fmt.Errorf("%s requires a number of lines", fields[i])
+			}
+			n, err := strconv.Atoi(fields[i+1])
+			if err != nil || n <= 0 {
+				return ConcatItem{}, fmt.Errorf("invalid %s line count %s (expected a positive number)", fields[i], fields[i+1])
+			}
+			if fields[i] == "head" {
+				item.Head = n
+			} else {
+				item.Tail = n
+			}
+			i++
+		case "grep":
+			filter := lineFilter{}
+			if i+1 < len(fields) && fields[i+1] == "-v" {
+				filter.invert = true
+				i++
+			}
+			if i+1 >= len(fields) {
+				return ConcatItem{}, fmt.Errorf("grep requires a pattern")
+			}
+			i++
+			pattern, err := regexp.Compile(fields[i])
+			if err != nil {
+				return ConcatItem{}, fmt.Errorf("invalid grep pattern %s: %v", fields[i], err)
+			}
+			filter.pattern = pattern
+			item.Filters = append(item.Filters, filter)
+		default:
+			return ConcatItem{}, fmt.Errorf("unexpected concat option: %s", fields[i])
+		}
+	}
+	return item, nil
+}
+
+// copyFilteredLines copies the lines of r selected by the Head and Tail of item that
+// pass all its Filters to w, keeping their line endings, and passes them through the
+// named filters of its Pipeline in order. Patterns are matched against the line
+// without its line ending. Reading stops after Head lines, and for Tail, a ring
+// buffer holds the last lines read until the end of the file.
+func copyFilteredLines(w io.Writer, r io.Reader, item ConcatItem) error {
+	stages := make([]lineStage, len(item.Pipeline))
+	for i, name := range item.Pipeline {
+		stages[i] = namedFilters[name]()
+	}
+	// write runs lines through the stages from the i-th on and writes what comes out.
+	var write func(lines []string, i int, done bool) error
+	write = func(lines []string, i int, done bool) error {
+		if i == len(stages) {
+			for _, line := range lines {
+				if _, err := io.WriteString(w, line); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		for _, line := range lines {
+			if err := write(stages[i](line, false), i+1, false); err != nil {
+				return err
+			}
+		}
+		if done {
+			// Flushed after the earlier stages, so that it sees the lines they held back
+			return write(stages[i]("", true), i+1, true)
+		}
+		return nil
+	}
+
+	// filter writes a selected line if it passes the filters.
+	filter := func(line string) error {
+		content := strings.TrimRight(line, "\r\n")
+		for _, f := range item.Filters {
+			if f.pattern.MatchString(content) == f.invert {
+				return nil
+			}
+		}
+		return write([]string{line}, 0, false)
+	}
+
+	var tail []string // Ring buffer of the last item.Tail lines, starting at tail[read%len]
+	read := 0
+	reader := bufio.NewReader(r)
+	for item.Head <= 0 || read < item.Head {
+		line, readErr := reader.ReadString('\n')
+		if line != "" {
+			if item.Tail > 0 {
+				if len(tail) < item.Tail {
+					tail = append(tail, line)
+				} else {
+					tail[read%item.Tail] = line
+				}
+			} else if err := filter(line); err != nil {
+				return err
+			}
+			read++
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	for i := range tail {
+		if err := filter(tail[(read+i)%len(tail)]); err != nil {
+			return err
+		}
+	}
+	return write(nil, 0, true)
+}
+
+// splitLineEnding splits a line into its content and its "\n" or "\r\n", if any.
+func splitLineEnding(line string) (string, string) {
+	content := strings.TrimRight(line, "\r\n")
+	return content, line[len(content):]
+}
+
+// mapLines returns a stage that replaces the content of every line with f of it.
+func mapLines(f func(string) string) lineStage {
+	return func(line string, done bool) []string {
+		if done {
+			return nil
+		}
+		content, ending := splitLineEnding(line)
+		return []string{f(content) + ending}
+	}
+}
+
+// newStripCommentsStage returns a stage for the strip-comments filter, which removes
+// SQL "--" and "/* */" comments outside single-quoted strings. Block comments and
+// strings may span lines. Lines that only held comments are dropped; other lines keep
+// their line ending, without the whitespace before a removed comment.
+func newStripCommentsStage() lineStage {
+	inComment, inString := false, false
+	return func(line string, done bool) []string {
+		if done {
+			return nil
+		}
+		content, ending := splitLineEnding(line)
+		var result strings.Builder
+		stripped := false
+		for i := 0; i < len(content); i++ {
+			switch {
+			case inComment:
+				if strings.HasPrefix(content[i:], "*/") {
+					inComment = false
+					i++
+				}
+				continue
+			case inString:
+				inString = content[i] != '\''
+			case content[i] == '\'':
+				inString = true
+			case strings.HasPrefix(content[i:], "--"):
+				stripped = true
+				i = len(content)
+				continue
+			case strings.HasPrefix(content[i:], "/*"):
+				inComment, stripped = true, true
+				i++
+				continue
+			}
+			result.WriteByte(content[i])
+		}
+		if !stripped && !inComment && result.Len() == len(content) {
+			return []string{line}
+		}
+		kept := strings.TrimRightFunc(result.String(), unicode.IsSpace)
+		if strings.TrimSpace(kept) == "" && strings.TrimSpace(content) != "" {
+			return nil
+		}
+		return []string{kept + ending}
+	}
+}
+
+// newTrimBlankLinesStage returns a stage for the trim-blank-lines filter, which
+// drops blank lines, including those with only whitespace, at the start and end of
+// the file. Blank lines in between are held back until a non-blank line follows.
+func newTrimBlankLinesStage() lineStage {
+	started := false
+	var held []string
+	return func(line string, done bool) []string {
+		if done {
+			return nil
+		}
+		if strings.TrimSpace(line) == "" {
+			if started {
+				held = append(held, line)
+			}
+			return nil
+		}
+		started = true
+		lines := append(held, line)
+		held = nil
+		return lines
+	}
+}
+
+func handleConcatTemplateCommand(args string, itemsToConcat *[]ConcatItem, baseDir string) error {
+	if args == "" {
+		return fmt.Errorf("concat-template requires a file path")
+	}
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: true, IsTemplate: true, Value: args, BaseDir: baseDir})
+	return nil
+}
+
+// copyTemplate copies r to w line by line, substituting parameters and escapes in
+// each line as emit does, so that large files are never held in memory. A reference
+// split across lines is therefore not substituted.
+func copyTemplate(w io.Writer, r io.Reader, parameters map[string]string) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, readErr := reader.ReadString('\n')
+		if line != "" {
+			line = unescapeString(unescapeDollars(substituteParams(line, parameters)))
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+func handleConcatSQLLiteralCommand(args string, itemsToConcat *[]ConcatItem, baseDir string) error {
+	if args == "" {
+		return fmt.Errorf("concat-sql-literal requires a file path")
+	}
+	// Escaped while the output is written, like emit-base64, so large files are never held in memory.
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: true, IsLiteral: true, Value: args, BaseDir: baseDir})
+	return nil
+}
+
+// sqlLiteralEscapers escape the contents of a single-quoted SQL string literal for
+// each --sql-dialect. Standard SQL only doubles quotes; MySQL also treats backslashes
+// as escapes, so they are doubled, and NUL bytes are written as \0. All patterns are
+// single bytes, so the escapers can be applied to any chunk of a file.
+var sqlLiteralEscapers = map[string]*strings.Replacer{
+	"standard": strings.NewReplacer("'", "''"),
+	"mysql":    strings.NewReplacer("'", "''", `\`, `\\`, "\x00", `\0`),
+}
+
+// copySQLLiteral writes the contents of r to w as a single-quoted SQL string literal,
+// escaped for --sql-dialect, a chunk at a time.
+func copySQLLiteral(w io.Writer, r io.Reader) error {
+	escaper := sqlLiteralEscapers[sqlDialect]
+	if _, err := io.WriteString(w, "'"); err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if _, err := escaper.WriteString(w, string(buf[:n])); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+	_, err := io.WriteString(w, "'")
+	return err
+}
+
+func handleConcatZipCommand(args string, itemsToConcat *[]ConcatItem, baseDir string) error {
+	if _, _, ok := splitZipPath(args); !ok {
+		return fmt.Errorf("concat-zip requires <archive>.zip:<entry>, got: %s", args)
+	}
+	// The archive is read while the output is written, like a concat file.
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsZip: true, Value: args, BaseDir: baseDir})
+	return nil
+}
+
+// splitZipPath splits "archive.zip:entry" into the archive path and the entry name
+// or pattern. The split is made after ".zip" so that paths with a drive letter work.
+func splitZipPath(value string) (string, string, bool) {
+	i := strings.Index(strings.ToLower(value), ".zip:")
+	if i < 0 || i+len(".zip:") == len(value) {
+		return "", "", false
+	}
+	return value[:i+len(".zip")], value[i+len(".zip:"):], true
+}
+
+// copyZipEntries writes the entries of a zip archive whose names match pattern (see
+// path.Match) to w, in name order. Matching no entries is an error.
+func copyZipEntries(w io.Writer, archivePath string, pattern string) error {
+	archive, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return fmt.Errorf("error opening archive %s: %w", archivePath, err)
+	}
+	defer archive.Close()
+
+	var entries []*zip.File
+	for _, entry := range archive.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		matched, err := path.Match(pattern, entry.Name)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+		if matched {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no entry matching %s in archive %s", pattern, archivePath)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	for _, entry := range entries {
+		reader, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("error opening %s in archive %s: %v", entry.Name, archivePath, err)
+		}
+		_, err = io.Copy(w, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("error copying %s from archive %s: %v", entry.Name, archivePath, err)
+		}
+	}
+	return nil
+}
+
+func handleEmitBase64Command(args string, itemsToConcat *[]ConcatItem, baseDir string) error {
+	if args == "" {
+		return fmt.Errorf("emit-base64 requires a file path")
+	}
+	// The file is encoded while the output is written, so large files are never held in memory.
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: true, IsBase64: true, Value: args, BaseDir: baseDir})
+	return nil
+}
+
+// handleConcatDirCommand handles concat-dir and, when recursive is set, concat-tree.
+func handleConcatDirCommand(command string, args string, recursive bool, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir string) error {
+	// The directory is read now, so its path is substituted now rather than in the final pass.
+	// A quoted directory may contain spaces; the options follow it.
+	args = substitutePath(args, parameters)
+	dir, rest, quoted := cutQuotedToken(args)
+	if !quoted {
+		if fields := strings.Fields(args); len(fields) > 0 {
+			dir, rest = fields[0], strings.Join(fields[1:], " ")
+		}
+	}
+	if dir == "" {
+		return fmt.Errorf("%s requires a directory path", command)
+	}
+	extension := ""
+	allowEmpty := false
+	dirsFirst := false
+	for _, option := range strings.Fields(rest) {
+		switch {
+		case option == "allow-empty":
+			allowEmpty = true
+		case strings.HasPrefix(option, "."):
+			extension = option
+		case recursive && option == "dirs-first":
+			dirsFirst = true
+		case recursive && option == "files-first":
+			dirsFirst = false
+		default:
+			return fmt.Errorf("unknown %s option: %s", command, option)
+		}
+	}
+
+	resolvedDir := dir
+	if !filepath.IsAbs(resolvedDir) {
+		resolvedDir = filepath.Join(baseDir, resolvedDir)
+	}
+	if err := checkInputPath(resolvedDir); err != nil {
+		return err
+	}
+	var names []string
+	var err error
+	if recursive {
+		names, err = listTreeFiles(resolvedDir, extension, dirsFirst)
+	} else {
+		names, err = listDirFiles(resolvedDir, extension)
+	}
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 && !allowEmpty {
+		return fmt.Errorf("no files to concatenate in directory %s", resolvedDir)
+	}
+	for _, name := range names {
+		*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: true, Value: filepath.Join(dir, name), BaseDir: baseDir})
+	}
+	return nil
+}
+
+// listDirFiles returns the names, sorted by --glob-order, of the files (not
+// subdirectories) in dir whose names end with extension, or of all files if
+// extension is empty.
+func listDirFiles(dir string, extension string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", dir, err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), extension) {
+			continue
+		}
+		// Stat rather than use the entry type so that symlinks are judged by their target.
+		info, err := os.Stat(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading directory entry %s: %w", entry.Name(), err)
+		}
+		if !info.IsDir() && inTimeWindow(info) {
+			names = append(names, entry.Name())
+		}
+	}
+	if err := sortNames(dir, names); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// parseTimeFlag parses a --since or --until value: an RFC 3339 time, or a duration
+// that is subtracted from now.
+func parseTimeFlag(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(-d), nil
+}
+
+// inTimeWindow reports whether a file's modification time is within --since and --until.
+func inTimeWindow(info os.FileInfo) bool {
+	if !sinceTime.IsZero() && info.ModTime().Before(sinceTime) {
+		return false
+	}
+	if !untilTime.IsZero() && info.ModTime().After(untilTime) {
+		return false
+	}
+	return true
+}
+
+// outputFrame returns the --header-file contents and the --footer-text, with
+// parameters substituted, that are written around the output and each write-to file.
+func outputFrame(parameters map[string]string) (string, string, error) {
+	var header string
+	if headerFile != "" {
+		referencedFiles = append(referencedFiles, headerFile)
+		content, err := os.ReadFile(headerFile)
+		if err != nil {
+			return "", "", fmt.Errorf("error reading header file: %w", err)
+		}
+		header = unescapeDollars(substituteParams(string(content), parameters))
+	}
+	footer := unescapeString(unescapeDollars(substituteParams(footerText, parameters)))
+	return header, footer, nil
+}
+
+// sortNames sorts the names of entries in dir according to --glob-order.
+func sortNames(dir string, names []string) error {
+	switch globOrder {
+	case "natural":
+		sort.SliceStable(names, func(i, j int) bool {
+			return naturalLess(names[i], names[j])
+		})
+	case "mtime":
+		modTimes := make(map[string]time.Time, len(names))
+		for _, name := range names {
+			info, err := os.Stat(filepath.Join(dir, name))
+			if err != nil {
+				return fmt.Errorf("error reading directory entry %s: %w", name, err)
+			}
+			modTimes[name] = info.ModTime()
+		}
+		sort.SliceStable(names, func(i, j int) bool {
+			if modTimes[names[i]].Equal(modTimes[names[j]]) {
+				return names[i] < names[j]
+			}
+			return modTimes[names[i]].Before(modTimes[names[j]])
+		})
+	default:
+		sort.Strings(names)
+	}
+	return nil
+}
+
+// naturalLess compares names with embedded runs of digits by their numeric value,
+// so that "file2.sql" sorts before "file10.sql". Numbers that are equal apart from
+// leading zeros are ordered by their length, then the rest of the names decide.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		aDigits, bDigits := leadingDigits(a), leadingDigits(b)
+		if aDigits == "" || bDigits == "" {
+			if a[0] != b[0] {
+				return a[0] < b[0]
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+		aNumber, bNumber := strings.TrimLeft(aDigits, "0"), strings.TrimLeft(bDigits, "0")
+		if len(aNumber) != len(bNumber) {
+			return len(aNumber) < len(bNumber)
+		}
+		if aNumber != bNumber {
+			return aNumber < bNumber
+		}
+		if len(aDigits) != len(bDigits) {
+			return len(aDigits) < len(bDigits)
+		}
+		a, b = a[len(aDigits):], b[len(bDigits):]
+	}
+	return len(a) < len(b)
+}
+
+// leadingDigits returns the run of ASCII digits at the start of s.
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+// listTreeFiles returns the paths, relative to root, of the files below root whose
+// names end with extension. Each directory's entries are sorted by --glob-order, and
+// its files are listed before its subdirectories unless dirsFirst is set. Symbolic
+// links to files are included; symbolic links to directories are not followed.
+func listTreeFiles(root string, extension string, dirsFirst bool) ([]string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %w", root, err)
+	}
+	var files, subdirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			subdirs = append(subdirs, entry.Name())
+			continue
+		}
+		if !strings.HasSuffix(entry.Name(), extension) {
+			continue
+		}
+		// Symlinks are judged, and filtered by time, by their target.
+		info, err := os.Stat(filepath.Join(root, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("error reading directory entry %s: %w", entry.Name(), err)
+		}
+		if info.IsDir() || !inTimeWindow(info) {
+			continue
+		}
+		files = append(files, entry.Name())
+	}
+	if err := sortNames(root, files); err != nil {
+		return nil, err
+	}
+	if err := sortNames(root, subdirs); err != nil {
+		return nil, err
+	}
+
+	var nested []string
+	for _, subdir := range subdirs {
+		subdirFiles, err := listTreeFiles(filepath.Join(root, subdir), extension, dirsFirst)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range subdirFiles {
+			nested = append(nested, filepath.Join(subdir, name))
+		}
+	}
+	if dirsFirst {
+		return append(nested, files...), nil
+	}
+	return append(files, nested...), nil
+}
+
+func handleWriteToCommand(args string, itemsToConcat *[]ConcatItem) error {
+	if args == "" {
+		return fmt.Errorf("write-to requires a file path")
+	}
+	// The switch is recorded as an item so that it takes effect in order during runConcat.
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsWriteTo: true, Value: args})
+	return nil
+}
+
+// handleIncludeCommand handles include and include-if-exists. The latter skips a
+// file that does not exist, but any other error is still reported. A path with
+// wildcards includes every matching file in turn, sorted by --glob-order; matching
+// no files is an error for include unless the allow-empty option is given.
+// include-glob always treats the path as a pattern, and its separator=TEXT option
+// emits TEXT between the output of consecutive files.
+func handleIncludeCommand(command, args string, currentInstructionsFile string, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir string) error {
+	includePath := args
+	allowEmpty := command == "include-if-exists"
+	separator := ""
+	if command == "include-glob" {
+		if option, rest, _ := strings.Cut(includePath, " "); strings.HasPrefix(option, "separator=") {
+			separator, includePath = strings.TrimPrefix(option, "separator="), strings.TrimSpace(rest)
+		}
+		if includePath == "" || includePath == "allow-empty" {
+			return fmt.Errorf("invalid include-glob command format: %s (expected [separator=TEXT] <pattern> [allow-empty])", args)
+		}
+	}
+	// include processes a file, unless include-once finds it was processed before in this run.
+	include := func(path string) error {
+		if err := checkInputPath(path); err != nil {
+			return err
+		}
+		includeEdges = append(includeEdges, includeEdge{from: currentInstructionsFile, to: path, command: command})
+		if command == "include-once" && includedFiles[path] {
+			return nil
+		}
+		if err := checkIncludeCycle(path); err != nil {
+			return err
+		}
+		includeDepth++
+		defer func() { includeDepth-- }()
+		return processInstructions(path, outputFile, itemsToConcat, parameters, filepath.Dir(path))
+	}
+	if strings.HasSuffix(includePath, " allow-empty") {
+		includePath = strings.TrimSpace(strings.TrimSuffix(includePath, " allow-empty"))
+		allowEmpty = true
+	}
+	if !filepath.IsAbs(includePath) {
+		absPath, err := filepath.Abs(filepath.Join(filepath.Dir(currentInstructionsFile), includePath))
+		if err != nil {
+			return fmt.Errorf("error resolving absolute path for %s: %v", includePath, err)
+		}
+		includePath = absPath
+	}
+	// Checked before looking for the file, so that whether a file outside the root
+	// exists cannot be told from the outcome.
+	if err := checkInputPath(includePath); err != nil {
+		return err
+	}
+	if command == "include-glob" || strings.ContainsAny(includePath, "*?[") {
+		matches, err := filepath.Glob(includePath)
+		if err != nil {
+			return fmt.Errorf("invalid include pattern %s: %v", args, err)
+		}
+		if len(matches) == 0 && !allowEmpty {
+			return fmt.Errorf("no files match include pattern %s", args)
+		}
+		if err := sortNames("", matches); err != nil {
+			return err
+		}
+		// Each file is processed in its own directory, and parameters set by one are
+		// seen by the next.
+		for i, match := range matches {
+			if i > 0 && separator != "" {
+				*itemsToConcat = append(*itemsToConcat, ConcatItem{Value: separator})
+			}
+			if err := include(match); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if command == "include-if-exists" {
+		if _, err := os.Stat(includePath); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	return include(includePath)
+}
+
+// checkIncludeCycle returns an error if path is already being processed, as
+// including it again would never end. The error shows the chain of includes that
+// leads back to it, relative to the directory of the main instructions file.
+func checkIncludeCycle(path string) error {
+	for i, open := range includeChain {
+		if open != path {
+			continue
+		}
+		var names []string
+		for _, name := range append(includeChain[i:], path) {
+			if rel, err := filepath.Rel(filepath.Dir(includeChain[0]), name); err == nil {
+				name = rel
+			}
+			names = append(names, filepath.ToSlash(name))
+		}
+		return newDSLError(DSLErrorCommand, "circular include: %s", strings.Join(names, " -> "))
+	}
+	return nil
+}
+
+// includeEdge records that an instructions file included another, for --graph.
+type includeEdge struct {
+	from, to string
+	command  string // include, include-once, include-if-exists or include-glob
+}
+
+// writeIncludeGraph writes the include edges of the run as a Graphviz DOT digraph,
+// with a node for every instructions file, starting with the main one. Edges are
+// drawn once, and those not made by plain include are labeled with their command,
+// even where include-once skipped the file.
+func writeIncludeGraph(filename string, instructionsFile string) error {
+	var b strings.Builder
+	b.WriteString("digraph includes {\n")
+	seen := make(map[string]bool)
+	addLine := func(line string) {
+		if !seen[line] {
+			seen[line] = true
+			b.WriteString("    " + line + ";\n")
+		}
+	}
+	addLine(dotQuote(graphNodeName(instructionsFile)))
+	for _, edge := range includeEdges {
+		addLine(dotQuote(graphNodeName(edge.to)))
+	}
+	for _, edge := range includeEdges {
+		line := dotQuote(graphNodeName(edge.from)) + " -> " + dotQuote(graphNodeName(edge.to))
+		if edge.command != "include" {
+			line += " [label=" + dotQuote(edge.command) + "]"
+		}
+		addLine(line)
+	}
+	b.WriteString("}\n")
+	return os.WriteFile(filename, []byte(b.String()), 0666)
+}
+
+// graphNodeName names an instructions file in the include graph by its path relative
+// to the current directory, with forward slashes, so that the same file always gets
+// the same node however it was reached.
+func graphNodeName(path string) string {
+	if absPath, err := filepath.Abs(path); err == nil {
+		path = absPath
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, absPath); err == nil {
+				path = rel
+			}
+		}
+	}
+	return filepath.ToSlash(path)
+}
+
+// dotQuote returns s as a double-quoted DOT string.
+func dotQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `\"`) + `"`
+}
+
+func handleParamCommand(args string, parameters map[string]string) error {
+	paramParts := strings.SplitN(args, "=", 2)
+	if len(paramParts) == 2 {
+		paramName := paramParts[0]
+		if err := checkNotBuiltin(paramName); err != nil {
+			return err
+		}
+		paramValue := paramParts[1] // This is the value that needs substitution
+
+		// Perform substitution on the value before storing it
+		substitutedValue := substituteParams(paramValue, parameters)
+
+		// 'param' has lower precedence than 'set'. Only set if not already defined.
+		if _, exists := parameters[paramName]; !exists {
+			parameters[paramName] = substitutedValue
+		}
+	} else {
+		return fmt.Errorf("invalid param command format: %s", args)
+	}
+	return nil
+}
+
+// handleParamFileIfCommand handles "param-file-if CONDITION FILE", which loads the
+// parameter file FILE, the last word of the line, if CONDITION holds at that point.
+// Like param, it only defines parameters that are not defined yet. A relative FILE
+// is resolved against baseDir.
+func handleParamFileIfCommand(args string, parameters map[string]string, baseDir string) error {
+	i := strings.LastIndexAny(args, " \t")
+	if i < 0 {
+		return fmt.Errorf("invalid param-file-if command format: %s (expected CONDITION FILE)", args)
+	}
+	condition, file := strings.TrimSpace(args[:i]), args[i+1:]
+	holds, err := evaluateCondition(condition, parameters)
+	if err != nil || !holds {
+		return err
+	}
+	file = unescapeDollars(substitutePath(file, parameters))
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(baseDir, file)
+	}
+	loaded := make(map[string]string)
+	if err := loadParamsFromFileIncludes(file, loaded, nil, true); err != nil {
+		return err
+	}
+	for name, value := range loaded {
+		if _, exists := parameters[name]; !exists {
+			parameters[name] = value
+		}
+	}
+	referencedFiles = append(referencedFiles, file)
+	return nil
+}
+
+// handleSetCommand handles set and set-lazy. set-lazy stores the raw value, which is
+// only substituted by resolveLazyParams once all instructions have been processed.
+func handleSetCommand(command, args string, parameters map[string]string) error {
+	setParts := strings.SplitN(args, "=", 2)
+	if len(setParts) == 2 {
+		paramName := setParts[0]
+		if err := checkNotBuiltin(paramName); err != nil {
+			return err
+		}
+		paramValue := setParts[1] // This is the value that needs substitution
+
+		// Only set the parameter if it was NOT set by a CLI --param flag
+		if _, isCliParam := cliParamsSet[paramName]; !isCliParam {
+			switch command {
+			case "set-lazy":
+				parameters[paramName] = paramValue
+				lazyParams[paramName] = true
+			case "set-if-unset":
+				// Unlike param, the only rule is whether the parameter currently exists
+				if _, exists := parameters[paramName]; !exists {
+					parameters[paramName] = substituteParams(paramValue, parameters)
+				}
+			case "set-upper", "set-lower":
+				// The value names an existing parameter, whose value is copied with its case changed
+				sourceValue, exists := parameters[paramValue]
+				if !exists {
+					return fmt.Errorf("%s: undefined parameter %s", command, paramValue)
+				}
+				if command == "set-upper" {
+					parameters[paramName] = strings.ToUpper(sourceValue)
+				} else {
+					parameters[paramName] = strings.ToLower(sourceValue)
+				}
+				delete(lazyParams, paramName)
+			default:
+				// Perform substitution on the value before storing it
+				parameters[paramName] = substituteParams(paramValue, parameters)
+				delete(lazyParams, paramName)
+			}
+		}
+	} else {
+		return fmt.Errorf("invalid %s command format: %s", command, args)
+	}
+	return nil
+}
+
+// handleSetDefaultCommand handles "set-default KEY from source, source, ...". Like
+// set-if-unset, it leaves a parameter that already has a value, from the command line
+// or anywhere else, alone. Otherwise it stores the value of the first source that
+// has one: "env:NAME" for an environment variable, "param:NAME" for another parameter
+// and "literal:TEXT" for TEXT itself, with parameters substituted. A literal takes
+// the rest of the line, commas included, so it must come last.
+func handleSetDefaultCommand(args string, parameters map[string]string) error {
+	paramName, sources, found := strings.Cut(args, " from ")
+	paramName = strings.TrimSpace(paramName)
+	if !found || paramName == "" || strings.TrimSpace(sources) == "" {
+		return fmt.Errorf("invalid set-default command format: %s (expected KEY from source, ...)", args)
+	}
+	if err := checkNotBuiltin(paramName); err != nil {
+		return err
+	}
+
+	var value string
+	hit := false
+	for rest := strings.TrimSpace(sources); rest != "" && !hit; {
+		kind, spec, ok := strings.Cut(rest, ":")
+		if !ok {
+			return fmt.Errorf("set-default: invalid source %q (expected env:NAME, param:NAME or literal:TEXT)", rest)
 		}
-		ifStk.push(conditionTrue)
-		*skip = !conditionTrue
+		kind = strings.TrimSpace(kind)
+		if kind == "literal" {
+			value, hit = substituteParams(spec, parameters), true
+			break
+		}
+		spec, rest, _ = strings.Cut(spec, ",")
+		spec, rest = strings.TrimSpace(spec), strings.TrimSpace(rest)
+		switch kind {
+		case "env":
+			value, hit = os.LookupEnv(spec)
+		case "param":
+			value, hit = parameters[spec]
+		default:
+			return fmt.Errorf("set-default: unknown source %q (expected env, param or literal)", kind)
+		}
+	}
+
+	if _, exists := parameters[paramName]; exists {
 		return nil
-	case "else":
-		if len(*ifStk) == 0 {
-			return fmt.Errorf("else without a preceding if")
+	}
+	if !hit {
+		return fmt.Errorf("set-default: none of the sources for %s has a value", paramName)
+	}
+	parameters[paramName] = value
+	return nil
+}
+
+// handleAppendCommand handles "append [separator=SEP] KEY=value", which adds value,
+// with parameters substituted, to the end of KEY's current value. The separator goes
+// between the two, and defaults to "," so that the result is a list for ${KEY[n]}; it
+// is left out when KEY is undefined or empty. Like set, append does not change a
+// parameter set on the command line.
+func handleAppendCommand(args string, parameters map[string]string) error {
+	separator := ","
+	if option, rest, ok := strings.Cut(args, " "); ok && strings.Contains(rest, "=") {
+		if value, isOption := strings.CutPrefix(option, "separator="); isOption {
+			separator, args = value, strings.TrimSpace(rest)
 		}
-		prevIfState, err := ifStk.pop()
-		if err != nil {
-			return err
+	}
+	paramName, value, ok := strings.Cut(args, "=")
+	if !ok || paramName == "" {
+		return fmt.Errorf("invalid append command format: %s (expected [separator=SEP] KEY=value)", args)
+	}
+	if err := checkNotBuiltin(paramName); err != nil {
+		return err
+	}
+	if cliParamsSet[paramName] {
+		return nil
+	}
+	value = substituteParams(value, parameters)
+	if current := parameters[paramName]; current != "" {
+		value = current + separator + value
+	}
+	parameters[paramName] = value
+	return nil
+}
+
+// resolveLazyParams substitutes the values of parameters defined with set-lazy until
+// they no longer change, so that they can refer to parameters defined after them.
+func resolveLazyParams(parameters map[string]string) error {
+	// A chain of references between lazy parameters is at most len(lazyParams) long;
+	// a reference to a lazy parameter that survives that many passes is circular.
+	for pass := 0; pass <= len(lazyParams); pass++ {
+		changed := false
+		for name := range lazyParams {
+			value := substituteParams(parameters[name], parameters)
+			if value != parameters[name] {
+				parameters[name] = value
+				changed = true
+			}
 		}
-		// If the previous 'if' was true, then the 'else' block should be skipped.
-		// If the previous 'if' was false, the 'else' block should be executed,
-		// but only if we are not already skipping due to an outer 'if'.
-		if prevIfState { // Previous 'if' was true, so skip this 'else' block
-			*skip = true
-		} else { // Previous 'if' was false, so execute this 'else' block
-			// Only set skip to false if no outer 'if' is currently skipping
-			if len(*ifStk) > 0 {
-				outerSkipState, err := ifStk.peek()
-				if err != nil {
-					return err
-				}
-				*skip = !outerSkipState // Revert to outer if's skip state
-			} else {
-				*skip = false // No outer if, so execute
+		if !changed {
+			break
+		}
+	}
+	// Escaped references, as in $${B}, are not references and are skipped.
+	for name := range lazyParams {
+		for _, match := range paramReference.FindAllStringSubmatch(parameters[name], -1) {
+			if match[1] == "" && lazyParams[match[2]] {
+				return fmt.Errorf("circular reference in lazy parameter %s", name)
 			}
 		}
-		ifStk.push(!prevIfState) // Push the new state for potential nested 'else' or 'endif'
+	}
+	return nil
+}
+
+func handlePrintCommand(args string, itemsToConcat *[]ConcatItem, parameters map[string]string) error {
+	// Add the parameter reference itself, to be substituted in the final pass.
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: false, Value: fmt.Sprintf("${%s}", args)})
+	return nil
+}
+
+// defaultPrintAllFormat is the print-all line format; {KEY} and {VALUE} are replaced
+// for each parameter.
+const defaultPrintAllFormat = "-- {KEY}={VALUE}@@n"
+
+func handlePrintAllCommand(args string, itemsToConcat *[]ConcatItem, parameters map[string]string) {
+	format := args
+	if format == "" {
+		format = defaultPrintAllFormat
+	}
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		if !builtinNames[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// Unlike print, the values are captured now, as they are at this point in the
+	// instructions, and are not substituted again in the final pass, as they may
+	// themselves contain ${...}.
+	format = substituteParams(format, parameters)
+	var lines strings.Builder
+	for _, name := range names {
+		line := strings.ReplaceAll(format, "{KEY}", name)
+		lines.WriteString(strings.ReplaceAll(line, "{VALUE}", parameters[name]))
+	}
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: false, IsResolved: true, Value: unescapeDollars(lines.String())})
+}
+
+// handleAbortCommand stops processing with the given message. Its parameters are
+// substituted now, as the message is reported before the final pass.
+func handleAbortCommand(args string, parameters map[string]string) error {
+	if args == "" {
+		return newDSLError(DSLErrorAbort, "aborted")
+	}
+	return newDSLError(DSLErrorAbort, "aborted: %s", unescapeDollars(substituteParams(args, parameters)))
+}
+
+// handleAssertCommand fails unless its condition, written as for if, is true. An
+// optional " : message" replaces the condition in the error.
+func handleAssertCommand(args string, parameters map[string]string) error {
+	condition, message, hasMessage := strings.Cut(args, " : ")
+	condition = strings.TrimSpace(condition)
+	if condition == "" {
+		return fmt.Errorf("assert requires a condition")
+	}
+	ok, err := evaluateCondition(condition, parameters)
+	if err != nil {
+		return &DSLError{Kind: DSLErrorCondition, Err: err}
+	}
+	if ok {
 		return nil
-	case "endif":
-		if len(*ifStk) == 0 {
-			return fmt.Errorf("endif without a preceding if")
+	}
+	if hasMessage {
+		return newDSLError(DSLErrorAssert, "assertion failed: %s", unescapeDollars(substituteParams(strings.TrimSpace(message), parameters)))
+	}
+	return newDSLError(DSLErrorAssert, "assertion failed: %s", condition)
+}
+
+// handleWarnCommand reports a warning on stderr and lets processing continue,
+// unless --werror is given.
+func handleWarnCommand(args string, parameters map[string]string) error {
+	message := unescapeDollars(substituteParams(args, parameters))
+	if warnAsError {
+		return fmt.Errorf("warning treated as error: %s", message)
+	}
+	printWarning("Warning: %s\n", message)
+	return nil
+}
+
+// handleExecCommand runs a shell command (only with --allow-exec) and either emits its
+// trimmed stdout or, for "exec NAME = command", stores it in a parameter like set.
+func handleExecCommand(args string, itemsToConcat *[]ConcatItem, parameters map[string]string) error {
+	if !allowExec {
+		return fmt.Errorf("exec requires the --allow-exec flag")
+	}
+	paramName := ""
+	shellCommand := args
+	if fields := strings.Fields(args); len(fields) > 2 && fields[1] == "=" {
+		paramName = fields[0]
+		shellCommand = strings.TrimSpace(strings.SplitN(args, "=", 2)[1])
+		if err := checkNotBuiltin(paramName); err != nil {
+			return err
 		}
-		_, err := ifStk.pop() // Pop from stack
-		if err != nil {
+	}
+	if shellCommand == "" {
+		return fmt.Errorf("exec requires a command")
+	}
+	// The command runs now, so its parameters are substituted now.
+	shellCommand = substituteParams(shellCommand, parameters)
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", shellCommand)
+	} else {
+		cmd = exec.Command("sh", "-c", shellCommand)
+	}
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("exec %s failed: %v: %s", shellCommand, err, strings.TrimSpace(stderr.String()))
+	}
+	output := strings.TrimSpace(stdout.String())
+
+	if paramName == "" {
+		*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: false, Value: output})
+	} else if !cliParamsSet[paramName] {
+		parameters[paramName] = output
+		delete(lazyParams, paramName)
+	}
+	return nil
+}
+
+// handleCountCommand handles "count NAME from glob PATTERN", which stores the number of
+// files matching PATTERN, relative to the current base directory (the instructions
+// file's directory, or the last chdir), in parameter NAME like set.
+// Directories are not counted, and nothing is concatenated.
+func handleCountCommand(args string, parameters map[string]string, baseDir string) error {
+	fields := strings.Fields(args)
+	if len(fields) < 4 || fields[1] != "from" || fields[2] != "glob" {
+		return fmt.Errorf("invalid count command format: %s (expected count NAME from glob PATTERN)", args)
+	}
+	paramName := fields[0]
+	if err := checkNotBuiltin(paramName); err != nil {
+		return err
+	}
+	pattern := substitutePath(strings.Join(fields[3:], " "), parameters)
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(baseDir, pattern)
+	}
+	// The pattern is checked too, so that a count of 0 does not reveal that nothing
+	// outside the root matches.
+	if err := checkInputPath(pattern); err != nil {
+		return err
+	}
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid count pattern %s: %v", pattern, err)
+	}
+	count := 0
+	for _, match := range matches {
+		if err := checkInputPath(match); err != nil {
 			return err
 		}
-		if len(*ifStk) > 0 {
-			currentIfState, err := ifStk.peek()
+		info, err := os.Stat(match)
+		if err != nil {
+			return fmt.Errorf("error checking file %s: %w", match, err)
+		}
+		if !info.IsDir() {
+			count++
+		}
+	}
+	if !cliParamsSet[paramName] {
+		parameters[paramName] = strconv.Itoa(count)
+		delete(lazyParams, paramName)
+	}
+	return nil
+}
+
+// handleSetFromJSONCommand handles "set-from-json NAME = file.json $.selector", which
+// stores one scalar value of a JSON file in parameter NAME like set.
+func handleSetFromJSONCommand(args string, parameters map[string]string, baseDir string) error {
+	fields := strings.Fields(args)
+	if len(fields) < 4 || fields[1] != "=" {
+		return fmt.Errorf("invalid set-from-json command format: %s (expected NAME = FILE SELECTOR)", args)
+	}
+	paramName := fields[0]
+	if err := checkNotBuiltin(paramName); err != nil {
+		return err
+	}
+	selector := fields[len(fields)-1]
+	jsonFile := substitutePath(unquoteArgs(strings.Join(fields[2:len(fields)-1], " ")), parameters)
+	if !filepath.IsAbs(jsonFile) {
+		jsonFile = filepath.Join(baseDir, jsonFile)
+	}
+	if err := checkInputPath(jsonFile); err != nil {
+		return err
+	}
+	content, err := os.ReadFile(jsonFile)
+	if err != nil {
+		return fmt.Errorf("error reading JSON file %s: %w", jsonFile, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber() // Keeps numbers exactly as written, e.g. 5432 rather than 5432.0
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return fmt.Errorf("error parsing JSON file %s: %v", jsonFile, err)
+	}
+	value, err := selectJSONValue(document, selector)
+	if err != nil {
+		return fmt.Errorf("set-from-json %s: %v", jsonFile, err)
+	}
+	if !cliParamsSet[paramName] {
+		parameters[paramName] = value
+		delete(lazyParams, paramName)
+	}
+	return nil
+}
+
+// selectJSONValue follows a selector such as $.database.hosts[0].name, where "$" is
+// the document and is optional, and returns the scalar it leads to. Strings are
+// returned unquoted, and numbers and booleans as written. Objects, arrays and null
+// are errors, as they have no single text value.
+func selectJSONValue(document interface{}, selector string) (string, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(selector, "$"), ".")
+	current := document
+	for rest != "" {
+		if strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return "", fmt.Errorf("invalid selector %s", selector)
+			}
+			index, err := strconv.Atoi(rest[1:end])
 			if err != nil {
-				return err
+				return "", fmt.Errorf("invalid array index in selector %s", selector)
 			}
-			*skip = !currentIfState // Revert to parent if's skip state
-		} else {
-			*skip = false // No more if blocks, so no skipping
+			array, ok := current.([]interface{})
+			if !ok || index < 0 || index >= len(array) {
+				return "", fmt.Errorf("%s does not match a value", selector)
+			}
+			current = array[index]
+			rest = strings.TrimPrefix(rest[end+1:], ".")
+			continue
 		}
-		return nil
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("%s does not match a value", selector)
+		}
+		if current, ok = object[rest[:end]]; !ok {
+			return "", fmt.Errorf("%s does not match a value", selector)
+		}
+		rest = strings.TrimPrefix(rest[end:], ".")
+	}
+	switch value := current.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case nil:
+		return "", fmt.Errorf("%s is null", selector)
+	}
+	return "", fmt.Errorf("%s selects an object or array, not a single value", selector)
+}
+
+func handleEmitCommand(args string, itemsToConcat *[]ConcatItem, parameters map[string]string) {
+	// Defer substitution to the final pass to respect parameter precedence.
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: false, Value: args})
+}
+
+// handleEmitNowCommand is like emit, but substitutes parameters with their values at
+// this point in the instructions rather than their final values.
+func handleEmitNowCommand(args string, itemsToConcat *[]ConcatItem, parameters map[string]string) {
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: false, Value: substituteParams(args, parameters)})
+}
+
+// handleEmitTimestampCommand adds the current time, formatted when the output is
+// written with the given Go time layout, or with --timestamp-format if there is none.
+// Parameters in the layout are substituted with their final values.
+func handleEmitTimestampCommand(args string, itemsToConcat *[]ConcatItem) {
+	if args == "" {
+		args = timestampFmt
+	}
+	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsTime: true, Value: args})
+}
+
+// replacement is a replace command, which applies to the first items of the run.
+type replacement struct {
+	from, to string
+	items    int // The number of items added before the command
+}
+
+// handleReplaceCommand handles "replace OLD NEW". OLD is a single word or a quoted
+// string, and NEW is the rest of the line, which may be quoted too (e.g. "" to
+// delete OLD). The replacement is made by applyReplacements.
+func handleReplaceCommand(args string, itemsToConcat []ConcatItem) error {
+	args = strings.TrimSpace(args)
+	var old, rest string
+	if args != "" && (args[0] == '"' || args[0] == '\'') {
+		end := strings.IndexByte(args[1:], args[0])
+		if end < 0 {
+			return fmt.Errorf("invalid replace command format: %s (unterminated quote)", args)
+		}
+		old, rest = args[1:end+1], args[end+2:]
+	} else {
+		old, rest, _ = strings.Cut(args, " ")
+	}
+	rest = strings.TrimSpace(rest)
+	if old == "" || rest == "" {
+		return fmt.Errorf("invalid replace command format: %s (expected replace OLD NEW)", args)
 	}
+	replacements = append(replacements, replacement{from: old, to: unquoteArgs(rest), items: len(itemsToConcat)})
 	return nil
 }
 
-func handleOutputCommand(args string, outputFile *string) {
-	*outputFile = args
+// applyReplacements makes the replacements of the replace commands, in order, in the
+// text items added before each command: emit, emit-now, print and exec output and
+// text blocks. Concatenated files, write-to paths and emit-timestamp are left alone.
+// Parameters in OLD and NEW are substituted with their final values, and both are
+// matched as written, before escapes such as @@n are turned into characters.
+func applyReplacements(items []ConcatItem, parameters map[string]string) error {
+	for _, r := range replacements {
+		from := unescapeDollars(substituteParams(r.from, parameters))
+		to := unescapeDollars(substituteParams(r.to, parameters))
+		for i := range items[:r.items] {
+			item := &items[i]
+			if item.IsFile || item.IsZip || item.IsWriteTo || item.IsTime {
+				continue
+			}
+			if item.IsTempFile {
+				err := rewriteTempFile(item.Value, func(line string) string {
+					return strings.ReplaceAll(line, from, to)
+				})
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			item.Value = strings.ReplaceAll(item.Value, from, to)
+		}
+	}
+	return nil
 }
 
-func handleConcatCommand(args string, itemsToConcat *[]ConcatItem, baseDir string) {
-	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: true, Value: args, BaseDir: baseDir})
+// instructionLine is a raw line of an instructions file and its 1-based line number.
+type instructionLine struct {
+	text   string
+	number int
 }
 
-func handleIncludeCommand(args string, currentInstructionsFile string, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir string) error {
-	includePath := args
-	if !filepath.IsAbs(includePath) {
-		absPath, err := filepath.Abs(filepath.Join(filepath.Dir(currentInstructionsFile), includePath))
-		if err != nil {
-			return fmt.Errorf("error resolving absolute path for %s: %v", includePath, err)
+// lineReader hands out the lines of an instructions file (or of a block within it)
+// in order, allowing block commands such as repeat to consume their body.
+type lineReader struct {
+	lines []instructionLine
+	pos   int
+}
+
+func (r *lineReader) next() (instructionLine, bool) {
+	if r.pos >= len(r.lines) {
+		return instructionLine{}, false
+	}
+	line := r.lines[r.pos]
+	r.pos++
+	return line, true
+}
+
+func readInstructionLines(instructionsFile string) ([]instructionLine, error) {
+	file, err := os.Open(instructionsFile)
+	if err != nil {
+		return nil, fmt.Errorf("error opening instructions file %s: %w", instructionsFile, err)
+	}
+	defer file.Close()
+
+	var lines []instructionLine
+	// ScanLines drops the "\r" of a "\r\n" line ending, so that commands and sentinels
+	// such as text-end match in instructions files written on Windows.
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, instructionLine{text: scanner.Text(), number: len(lines) + 1})
+	}
+	return lines, scanner.Err()
+}
+
+// commandName returns the command word of an instructions line under the given
+// prefix, or "" for blank lines, comments and lines ignored because of the prefix.
+func commandName(line string, prefix string) string {
+	trimmedLine := strings.TrimSpace(line)
+	if trimmedLine == "" || strings.HasPrefix(trimmedLine, commentChar) {
+		return ""
+	}
+	if prefix != "" {
+		var ok bool
+		if trimmedLine, ok = strings.CutPrefix(trimmedLine, prefix+":"); !ok {
+			return ""
 		}
-		includePath = absPath
 	}
-	err := processInstructions(includePath, outputFile, itemsToConcat, parameters, filepath.Dir(includePath))
+	fields := strings.Fields(trimmedLine)
+	if len(fields) == 0 {
+		return "" // Only the prefix, which dispatchCommand reports as an unknown command
+	}
+	return fields[0]
+}
+
+// readBlockBody consumes lines from src up to the end command matching an already
+// read begin command. Nested blocks of the same kind are kept in the body and the
+// contents of text blocks are never mistaken for commands.
+func readBlockBody(src *lineReader, begin, end string, prefix string) ([]instructionLine, error) {
+	var body []instructionLine
+	depth := 0
+	inTextBlock := false
+	textEnd := ""
+	for {
+		line, ok := src.next()
+		if !ok {
+			return nil, newDSLError(DSLErrorUnclosedBlock, "%s without a matching %s", begin, end)
+		}
+		if inTextBlock {
+			trimmedLine := strings.TrimSpace(line.text)
+			if prefix != "" {
+				trimmedLine = strings.TrimPrefix(trimmedLine, prefix+":")
+			}
+			inTextBlock = trimmedLine != textEnd
+			body = append(body, line)
+			continue
+		}
+		switch commandName(line.text, prefix) {
+		case begin:
+			depth++
+		case end:
+			if depth == 0 {
+				return body, nil
+			}
+			depth--
+		case "text-begin":
+			inTextBlock = true
+			textEnd = textBlockEnd(line.text, prefix)
+		}
+		body = append(body, line)
+	}
+}
+
+// section is a named block of instruction lines captured by define-section.
+type section struct {
+	lines   []instructionLine
+	file    string // The instructions file that defines the section
+	baseDir string // Relative paths in the section are resolved against its defining file
+	prefix  string // The command prefix in effect where the section was defined
+	inUse   bool   // Set while the section is being processed, to catch recursion
+}
+
+func handleDefineSectionCommand(args string, ctx lineContext, src *lineReader, baseDir string, currentPrefix *string) error {
+	name := strings.TrimSpace(args)
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid section name: %q", name)
+	}
+	body, err := readBlockBody(src, "define-section", "end-section", *currentPrefix)
 	if err != nil {
 		return err
 	}
+	if existing, ok := sections[name]; ok && existing.inUse {
+		return fmt.Errorf("section %s cannot be redefined while it is in use", name)
+	}
+	// A later definition replaces an earlier one.
+	sections[name] = section{lines: body, file: ctx.file, baseDir: baseDir, prefix: *currentPrefix}
 	return nil
 }
 
-func handleParamCommand(args string, parameters map[string]string) error {
-	paramParts := strings.SplitN(args, "=", 2)
-	if len(paramParts) == 2 {
-		paramName := paramParts[0]
-		paramValue := paramParts[1] // This is the value that needs substitution
+// handleUseSectionCommand processes the lines of a section as if they appeared at
+// this point, so parameters are substituted with their values at use time.
+func handleUseSectionCommand(args string, ctx lineContext, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string) error {
+	name := strings.TrimSpace(args)
+	sec, ok := sections[name]
+	if !ok {
+		return fmt.Errorf("undefined section: %s", name)
+	}
+	if sec.inUse {
+		return fmt.Errorf("section %s uses itself", name)
+	}
+	sec.inUse = true
+	sections[name] = sec
+	defer func() {
+		sec.inUse = false
+		sections[name] = sec
+	}()
 
-		// Perform substitution on the value before storing it
-		substitutedValue := substituteParams(paramValue, parameters)
+	sectionCtx := lineContext{file: sec.file, iteration: ctx.iteration, inSection: true}
+	prefix, baseDir := sec.prefix, sec.baseDir
+	return processLines(&lineReader{lines: sec.lines}, sectionCtx, outputFile, itemsToConcat, parameters, &baseDir, &prefix)
+}
 
-		// 'param' has lower precedence than 'set'. Only set if not already defined.
-		if _, exists := parameters[paramName]; !exists {
-			parameters[paramName] = substitutedValue
+func handleRepeatCommand(args string, ctx lineContext, src *lineReader, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir *string, currentPrefix *string) error {
+	countText := substituteParams(args, parameters)
+	count, err := strconv.Atoi(countText)
+	if err != nil || count < 0 {
+		return fmt.Errorf("invalid repeat count: %s", countText)
+	}
+	body, err := readBlockBody(src, "repeat", "endrepeat", *currentPrefix)
+	if err != nil {
+		return err
+	}
+	// __ITER__ is also visible to conditions in the body; restore the value of an
+	// enclosing repeat block afterwards.
+	outerIteration, nested := parameters["__ITER__"]
+	defer func() {
+		if nested {
+			parameters["__ITER__"] = outerIteration
+		} else {
+			delete(parameters, "__ITER__")
+		}
+	}()
+	for i := 1; i <= count; i++ {
+		iterCtx := ctx
+		iterCtx.iteration = strconv.Itoa(i)
+		parameters["__ITER__"] = iterCtx.iteration
+		err := processLines(&lineReader{lines: body}, iterCtx, outputFile, itemsToConcat, parameters, baseDir, currentPrefix)
+		if err != nil {
+			return err
 		}
-	} else {
-		return fmt.Errorf("invalid param command format: %s", args)
 	}
 	return nil
 }
 
-func handleSetCommand(args string, parameters map[string]string) error {
-	setParts := strings.SplitN(args, "=", 2)
-	if len(setParts) == 2 {
-		paramName := setParts[0]
-		paramValue := setParts[1] // This is the value that needs substitution
+// switchCase is one case (or the default) of a switch block.
+type switchCase struct {
+	label     string
+	isDefault bool
+	body      []instructionLine
+}
 
-		// Perform substitution on the value before storing it
-		substitutedValue := substituteParams(paramValue, parameters)
+// splitSwitchBody splits the body of a switch block into its cases. Lines belonging to
+// nested switch blocks and text blocks stay within the case that contains them.
+func splitSwitchBody(body []instructionLine, prefix string) ([]switchCase, error) {
+	var cases []switchCase
+	depth := 0
+	inTextBlock := false
+	textEnd := ""
+	for _, line := range body {
+		if inTextBlock {
+			trimmedLine := strings.TrimSpace(line.text)
+			if prefix != "" {
+				trimmedLine = strings.TrimPrefix(trimmedLine, prefix+":")
+			}
+			inTextBlock = trimmedLine != textEnd
+		} else {
+			command := commandName(line.text, prefix)
+			switch {
+			case command == "switch":
+				depth++
+			case command == "endswitch":
+				depth--
+			case command == "text-begin":
+				inTextBlock = true
+				textEnd = textBlockEnd(line.text, prefix)
+			case depth == 0 && (command == "case" || command == "default"):
+				commandLine := strings.TrimSpace(stripTrailingComment(strings.TrimSpace(line.text)))
+				if prefix != "" {
+					commandLine = strings.TrimPrefix(commandLine, prefix+":")
+				}
+				label := unquoteArgs(strings.TrimSpace(strings.TrimPrefix(commandLine, command)))
+				if command == "default" {
+					for _, c := range cases {
+						if c.isDefault {
+							return nil, fmt.Errorf("switch has more than one default")
+						}
+					}
+				} else if label == "" {
+					return nil, fmt.Errorf("case requires a value")
+				}
+				cases = append(cases, switchCase{label: label, isDefault: command == "default"})
+				continue
+			case command != "" && len(cases) == 0:
+				return nil, fmt.Errorf("command before the first case in switch: %s", command)
+			}
+		}
+		if len(cases) > 0 {
+			cases[len(cases)-1].body = append(cases[len(cases)-1].body, line)
+		}
+	}
+	return cases, nil
+}
+
+func handleSwitchCommand(args string, ctx lineContext, src *lineReader, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir *string, currentPrefix *string) error {
+	if args == "" {
+		return fmt.Errorf("switch requires a parameter name")
+	}
+	body, err := readBlockBody(src, "switch", "endswitch", *currentPrefix)
+	if err != nil {
+		return err
+	}
+	cases, err := splitSwitchBody(body, *currentPrefix)
+	if err != nil {
+		return err
+	}
 
-		// Only set the parameter if it was NOT set by a CLI --param flag
-		if _, isCliParam := cliParamsSet[paramName]; !isCliParam {
-			parameters[paramName] = substitutedValue
+	value, isSet := parameters[args]
+	var selected *switchCase
+	for i := range cases {
+		if cases[i].isDefault {
+			if selected == nil {
+				selected = &cases[i]
+			}
+		} else if isSet && substituteParams(cases[i].label, parameters) == value {
+			selected = &cases[i]
+			break
 		}
-	} else {
-		return fmt.Errorf("invalid set command format: %s", args)
 	}
-	return nil
+	if selected == nil {
+		return nil
+	}
+	// Only the selected case is processed; cases never fall through.
+	return processLines(&lineReader{lines: selected.body}, ctx, outputFile, itemsToConcat, parameters, baseDir, currentPrefix)
 }
 
-func handlePrintCommand(args string, itemsToConcat *[]ConcatItem, parameters map[string]string) error {
-	// Add the parameter reference itself, to be substituted in the final pass.
-	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: false, Value: fmt.Sprintf("${%s}", args)})
-	return nil
+// isConditionalCommand reports whether command is handled by handleConditionalCommand,
+// which runs even in a skipped branch to keep track of nesting.
+func isConditionalCommand(command string) bool {
+	switch command {
+	case "if", "if-file-exists", "if-file-nonempty", "else", "endif":
+		return true
+	}
+	return false
 }
 
-func handleEmitCommand(args string, itemsToConcat *[]ConcatItem, parameters map[string]string) {
-	// Defer substitution to the final pass to respect parameter precedence.
-	*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: false, Value: args})
+// traceCommand logs a dispatched command to stderr when --trace is given. status is
+// "run", "skipped" (in a false if branch) or "ignored" (missing the active prefix).
+func traceCommand(ctx lineContext, line string, status string, depth int, prefix string) {
+	if !traceMode {
+		return
+	}
+	if logFormat == "json" {
+		logJSON("trace", line, map[string]interface{}{"file": ctx.file, "line": ctx.line, "status": status, "depth": depth, "prefix": prefix})
+		return
+	}
+	fmt.Fprintf(os.Stderr, "trace: %s:%d: %s [%s depth=%d prefix=%q]\n", ctx.file, ctx.line, line, status, depth, prefix)
 }
 
-func dispatchCommand(line string, instructionsFile string, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir string, currentPrefix *string, ifStk *ifStack, skip *bool) (bool, error) {
+func dispatchCommand(line string, ctx lineContext, src *lineReader, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir *string, currentPrefix *string, ifStk *ifStack, skip *bool, textOpts *textBlockOptions) (bool, error) {
 	textBegan := false // New variable to track if text-begin was found
 	if *currentPrefix != "" {
 		prefixWithColon := *currentPrefix + ":"
 		if strings.HasPrefix(line, prefixWithColon) {
 			if line == prefixWithColon+"clear-prefix" {
+				traceCommand(ctx, line, "run", len(*ifStk), *currentPrefix)
 				*currentPrefix = ""
 				return textBegan, nil
 			}
 			line = strings.TrimPrefix(line, prefixWithColon)
 		} else {
 			// If prefix is set, ignore all commands that don't have it
+			traceCommand(ctx, line, "ignored", len(*ifStk), *currentPrefix)
 			return textBegan, nil
 		}
 	}
@@ -393,9 +4006,16 @@ func dispatchCommand(line string, instructionsFile string, outputFile *string, i
 		args = parts[1]
 	}
 
-	switch command {
-	case "if", "else", "endif":
-		return textBegan, handleConditionalCommand(command, args, parameters, ifStk, skip)
+	if traceMode {
+		status := "run"
+		if *skip && !isConditionalCommand(command) && command != "set-prefix" {
+			status = "skipped"
+		}
+		traceCommand(ctx, line, status, len(*ifStk), *currentPrefix)
+	}
+
+	if isConditionalCommand(command) {
+		return textBegan, handleConditionalCommand(command, args, parameters, *baseDir, ifStk, skip)
 	}
 
 	if command == "set-prefix" {
@@ -407,116 +4027,854 @@ func dispatchCommand(line string, instructionsFile string, outputFile *string, i
 		return textBegan, nil
 	}
 
+	// concat, concat-dir and concat-tree read their own quoting, as options may follow
+	// a quoted path.
+	rawArgs := args
+	args = unquoteArgs(args)
+
 	switch command {
 	case "output":
-		handleOutputCommand(args, outputFile)
+		return textBegan, handleOutputCommand(args, outputFile)
 	case "concat":
-		handleConcatCommand(args, itemsToConcat, baseDir)
-	case "include":
-		return textBegan, handleIncludeCommand(args, instructionsFile, outputFile, itemsToConcat, parameters, baseDir)
+		return textBegan, handleConcatCommand(rawArgs, itemsToConcat, *baseDir)
+	case "concat-zip":
+		return textBegan, handleConcatZipCommand(args, itemsToConcat, *baseDir)
+	case "concat-template":
+		return textBegan, handleConcatTemplateCommand(args, itemsToConcat, *baseDir)
+	case "emit-base64":
+		return textBegan, handleEmitBase64Command(args, itemsToConcat, *baseDir)
+	case "concat-sql-literal":
+		return textBegan, handleConcatSQLLiteralCommand(args, itemsToConcat, *baseDir)
+	case "concat-dir":
+		return textBegan, handleConcatDirCommand(command, rawArgs, false, itemsToConcat, parameters, *baseDir)
+	case "concat-tree":
+		return textBegan, handleConcatDirCommand(command, rawArgs, true, itemsToConcat, parameters, *baseDir)
+	case "write-to":
+		return textBegan, handleWriteToCommand(args, itemsToConcat)
+	case "include", "include-if-exists", "include-once", "include-glob":
+		return textBegan, handleIncludeCommand(command, args, ctx.file, outputFile, itemsToConcat, parameters, *baseDir)
 	case "param":
 		return textBegan, handleParamCommand(args, parameters)
-	case "set":
-		return textBegan, handleSetCommand(args, parameters)
+	case "param-file-if":
+		return textBegan, handleParamFileIfCommand(args, parameters, *baseDir)
+	case "set", "set-lazy", "set-upper", "set-lower", "set-if-unset":
+		return textBegan, handleSetCommand(command, args, parameters)
+	case "append":
+		return textBegan, handleAppendCommand(args, parameters)
+	case "set-default":
+		return textBegan, handleSetDefaultCommand(args, parameters)
 	case "print":
 		return textBegan, handlePrintCommand(args, itemsToConcat, parameters)
+	case "print-all":
+		handlePrintAllCommand(args, itemsToConcat, parameters)
 	case "emit":
 		handleEmitCommand(args, itemsToConcat, parameters)
+	case "emit-now":
+		handleEmitNowCommand(args, itemsToConcat, parameters)
+	case "emit-timestamp":
+		handleEmitTimestampCommand(args, itemsToConcat)
+	case "replace":
+		return textBegan, handleReplaceCommand(args, *itemsToConcat)
+	case "abort":
+		return textBegan, handleAbortCommand(args, parameters)
+	case "warn":
+		return textBegan, handleWarnCommand(args, parameters)
+	case "assert":
+		return textBegan, handleAssertCommand(args, parameters)
+	case "count":
+		return textBegan, handleCountCommand(args, parameters, *baseDir)
+	case "set-from-json":
+		return textBegan, handleSetFromJSONCommand(args, parameters, *baseDir)
+	case "exec":
+		return textBegan, handleExecCommand(args, itemsToConcat, parameters)
+	case "switch":
+		return textBegan, handleSwitchCommand(args, ctx, src, outputFile, itemsToConcat, parameters, baseDir, currentPrefix)
+	case "case", "default", "endswitch":
+		return textBegan, newDSLError(DSLErrorUnmatchedBlock, "%s without a preceding switch", command)
+	case "define-section":
+		return textBegan, handleDefineSectionCommand(args, ctx, src, *baseDir, currentPrefix)
+	case "end-section":
+		return textBegan, newDSLError(DSLErrorUnmatchedBlock, "end-section without a preceding define-section")
+	case "use-section":
+		return textBegan, handleUseSectionCommand(args, ctx, outputFile, itemsToConcat, parameters)
+	case "repeat":
+		return textBegan, handleRepeatCommand(args, ctx, src, outputFile, itemsToConcat, parameters, baseDir, currentPrefix)
+	case "endrepeat":
+		return textBegan, newDSLError(DSLErrorUnmatchedBlock, "endrepeat without a preceding repeat")
+	case "chdir":
+		return textBegan, handleChdirCommand(args, parameters, baseDir)
 	case "text-begin":
+		opts, err := parseTextBlockOptions(args)
+		if err != nil {
+			return textBegan, err
+		}
+		*textOpts = opts
 		textBegan = true
 	default:
-		return textBegan, fmt.Errorf("unknown command: %s", command)
+		return textBegan, newDSLError(DSLErrorUnknownCommand, "unknown command: %s", command)
 	}
 	return textBegan, nil
 }
 
 func processInstructions(instructionsFile string, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir string) error {
-	file, err := os.Open(instructionsFile)
+	referencedFiles = append(referencedFiles, instructionsFile)
+	if absPath, err := filepath.Abs(instructionsFile); err == nil {
+		includedFiles[absPath] = true
+		includeChain = append(includeChain, absPath)
+		defer func() { includeChain = includeChain[:len(includeChain)-1] }()
+	}
+	lines, err := readInstructionLines(instructionsFile)
 	if err != nil {
-		return fmt.Errorf("error opening instructions file %s: %v", instructionsFile, err)
+		return err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
+	var currentPrefix string
+	return processLines(&lineReader{lines: lines}, lineContext{file: instructionsFile}, outputFile, itemsToConcat, parameters, &baseDir, &currentPrefix)
+}
+
+// processLines processes the lines of an instructions file or of a repeat block.
+// Conditional and text blocks must be closed within the same lines.
+func processLines(src *lineReader, ctx lineContext, outputFile *string, itemsToConcat *[]ConcatItem, parameters map[string]string, baseDir *string, currentPrefix *string) error {
 	inTextBlock := false
-	var textBlock strings.Builder
+	var textLines []string
+	var textOpts textBlockOptions
+	textStart := 0 // Line of the text-begin of the open text block
 
 	ifStk := ifStack{}
 	skip := false
-	var currentPrefix string
 
-	for scanner.Scan() {
-		line := scanner.Text()
+	for {
+		instructionLine, ok := src.next()
+		if !ok {
+			break
+		}
+		line := instructionLine.text
+		ctx.line = instructionLine.number
 
 		if inTextBlock {
 			trimmedLine := strings.TrimSpace(line)
-			if currentPrefix != "" {
-				prefixWithColon := currentPrefix + ":"
+			if *currentPrefix != "" {
+				prefixWithColon := *currentPrefix + ":"
 				if strings.HasPrefix(trimmedLine, prefixWithColon) {
 					trimmedLine = strings.TrimPrefix(trimmedLine, prefixWithColon)
 				}
 			}
 
-			if trimmedLine == "text-end" {
-				*itemsToConcat = append(*itemsToConcat, ConcatItem{IsFile: false, Value: textBlock.String()})
+			if trimmedLine == textOpts.end {
+				item, err := textBlockItem(textLines, textOpts)
+				if err != nil {
+					return locateDSLError(err, ctx, "text-end")
+				}
+				*itemsToConcat = append(*itemsToConcat, item)
 				inTextBlock = false
-				textBlock.Reset()
+				textLines = nil
 			} else {
-				textBlock.WriteString(line + "\n")
+				line = substituteLocation(line, ctx)
+				if ctx.inSection {
+					line = substituteParams(line, parameters)
+				}
+				textLines = append(textLines, line)
 			}
 			continue
 		}
 
 		trimmedLine := strings.TrimSpace(line)
-		if trimmedLine == "" || strings.HasPrefix(trimmedLine, "#") {
+		if trimmedLine == "" || strings.HasPrefix(trimmedLine, commentChar) {
 			continue
 		}
+		trimmedLine = substituteLocation(stripTrailingComment(trimmedLine), ctx)
+		if ctx.inSection && (substitutePaths || !pathCommands[commandName(trimmedLine, *currentPrefix)]) {
+			trimmedLine = substituteParams(trimmedLine, parameters)
+		}
 
-		textBegan, err := dispatchCommand(trimmedLine, instructionsFile, outputFile, itemsToConcat, parameters, baseDir, &currentPrefix, &ifStk, &skip)
+		textBegan, err := dispatchCommand(trimmedLine, ctx, src, outputFile, itemsToConcat, parameters, baseDir, currentPrefix, &ifStk, &skip, &textOpts)
 		if err != nil {
+			command := commandName(trimmedLine, *currentPrefix)
+			err = locateDSLError(err, ctx, command)
+			if keepGoing && canKeepGoing(err, command) {
+				keptErrors = append(keptErrors, err)
+				continue
+			}
 			return err
 		}
+		if textBegan {
+			textStart = ctx.line
+		}
 		inTextBlock = textBegan
 	}
 
+	if inTextBlock {
+		// Otherwise a misspelled delimiter would silently swallow the rest of the file.
+		return &DSLError{File: ctx.file, Line: textStart, Command: "text-begin", Kind: DSLErrorUnclosedBlock, Err: fmt.Errorf("text-begin without matching %s", textOpts.end)}
+	}
 	if len(ifStk) > 0 {
-		return fmt.Errorf("unclosed if block(s)")
+		return &DSLError{File: ctx.file, Command: "if", Kind: DSLErrorUnclosedBlock, Err: fmt.Errorf("unclosed if block(s)")}
 	}
+	return nil
+}
 
-	return scanner.Err()
+// validateItems checks for --validate that every file to be concatenated exists and
+// is not a directory, without reading it. Missing files are accepted with
+// --on-missing-file skip. The entries of zip archives are not checked.
+func validateItems(items []ConcatItem) error {
+	for _, item := range items {
+		if err := validateItem(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateItem checks a single item for validateItems. Items that are not files
+// are always valid.
+func validateItem(item ConcatItem) error {
+	if !item.IsFile && !item.IsZip {
+		return nil
+	}
+	path := unescapeString(item.Value)
+	if item.IsZip {
+		path, _, _ = splitZipPath(path)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(item.BaseDir, path)
+	}
+	info, err := os.Stat(path)
+	if err != nil && onMissing == "skip" && !item.IsZip && errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error checking file %s: %w", path, err)
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
+	return nil
+}
+
+// diffOutput generates the output in memory for --diff and prints a unified diff
+// against the existing file, which is treated as empty if it does not exist. It
+// returns errOutputDiffers if there are differences.
+func diffOutput(outputPath string, items []ConcatItem, parameters map[string]string) error {
+	for _, item := range items {
+		if item.IsWriteTo {
+			return fmt.Errorf("--diff cannot be used with write-to")
+		}
+	}
+	var generated bytes.Buffer
+	if err := runConcat(&generated, items, parameters, nil); err != nil {
+		if errors.Is(err, errNoOutput) || errors.Is(err, errOutputTooLarge) {
+			return fmt.Errorf("during concatenation: %w", err)
+		}
+		return &exitCodeError{code: exitIO, err: fmt.Errorf("during concatenation: %w", err)}
+	}
+	existing, err := os.ReadFile(outputPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &exitCodeError{code: exitIO, err: fmt.Errorf("reading output file %s: %w", outputPath, err)}
+	}
+	if bytes.Equal(existing, generated.Bytes()) {
+		return nil
+	}
+	name := filepath.ToSlash(outputPath)
+	writeUnifiedDiff(os.Stdout, name, name, splitLines(string(existing)), splitLines(generated.String()))
+	return errOutputDiffers
+}
+
+// splitLines splits s into lines that keep their "\n", so that a missing final
+// line break counts as a difference.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffOp is a line of a diff: ' ' for a line in both, '-' for a removed line and
+// '+' for an added one.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines computes a shortest edit script from a to b with the linear-space
+// variant of Myers' algorithm, so that memory grows with the number of lines rather
+// than with the number of lines times the number of differences.
+func diffLines(a, b []string) []diffOp {
+	var ops []diffOp
+	diffRange(a, b, &ops)
+	return ops
+}
+
+// diffRange appends the edits from a to b to ops. Common leading and trailing lines
+// are matched directly; what remains is split at the middle snake of a shortest edit
+// script, and each half is diffed in turn.
+func diffRange(a, b []string, ops *[]diffOp) {
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		*ops = append(*ops, diffOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	common := 0
+	for common < len(a) && common < len(b) && a[len(a)-1-common] == b[len(b)-1-common] {
+		common++
+	}
+	suffix := a[len(a)-common:]
+	a, b = a[:len(a)-common], b[:len(b)-common]
+
+	switch {
+	case len(a) == 0:
+		for _, line := range b {
+			*ops = append(*ops, diffOp{'+', line})
+		}
+	case len(b) == 0:
+		for _, line := range a {
+			*ops = append(*ops, diffOp{'-', line})
+		}
+	default:
+		// Both ends differ, so there are at least two edits, and each half has fewer.
+		x, y, u, v := middleSnake(a, b)
+		diffRange(a[:x], b[:y], ops)
+		for _, line := range a[x:u] {
+			*ops = append(*ops, diffOp{' ', line})
+		}
+		diffRange(a[u:], b[v:], ops)
+	}
+	for _, line := range suffix {
+		*ops = append(*ops, diffOp{' ', line})
+	}
+}
+
+// middleSnake finds the middle snake of a shortest edit script from a to b, a run of
+// matching lines from (x, y) to (u, v) about halfway along it, by searching forward
+// from the start and backward from the end at the same time. The backward search
+// works on reversed coordinates, counting lines from the ends of a and b.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD + 1
+	forward := make([]int, 2*offset+1)
+	backward := make([]int, 2*offset+1)
+	delta := n - m
+	odd := delta%2 != 0
+	for d := 0; d <= maxD; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+			// The backward search has taken d-1 steps; its diagonal delta-k meets this one.
+			if back := delta - k; odd && back >= -(d-1) && back <= d-1 && u+backward[offset+back] >= n {
+				return x, y, u, v
+			}
+		}
+		for k := -d; k <= d; k += 2 {
+			var bx int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				bx = backward[offset+k+1]
+			} else {
+				bx = backward[offset+k-1] + 1
+			}
+			by := bx - k
+			ex, ey := bx, by
+			for ex < n && ey < m && a[n-1-ex] == b[m-1-ey] {
+				ex++
+				ey++
+			}
+			backward[offset+k] = ex
+			if fwd := delta - k; !odd && fwd >= -d && fwd <= d && forward[offset+fwd]+ex >= n {
+				return n - ex, m - ey, n - bx, m - by
+			}
+		}
+	}
+	return 0, 0, 0, 0 // Not reached: the searches meet within maxD steps
+}
+
+// writeUnifiedDiff writes the differences between a and b in unified format, with
+// three lines of context around each change.
+func writeUnifiedDiff(w io.Writer, nameA, nameB string, a, b []string) {
+	const context = 3
+	ops := diffLines(a, b)
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		// A hunk runs from context lines before this change to context lines after
+		// the last change with no more than 2*context unchanged lines before it.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		last := i
+		for j := i; j < len(ops) && j-last <= 2*context; j++ {
+			if ops[j].kind != ' ' {
+				last = j
+			}
+		}
+		end := last + context + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		lineA, lineB := 1, 1
+		for _, op := range ops[:start] {
+			if op.kind != '+' {
+				lineA++
+			}
+			if op.kind != '-' {
+				lineB++
+			}
+		}
+		countA, countB := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				countA++
+			}
+			if op.kind != '-' {
+				countB++
+			}
+		}
+		// An empty range is numbered by the line before it, as diff does.
+		if countA == 0 {
+			lineA--
+		}
+		if countB == 0 {
+			lineB--
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", lineA, countA, lineB, countB)
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(w, "%c%s", op.kind, op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		i = end
+	}
+}
+
+// copyFirstSourceMode gives outputPath, for --preserve-permissions, the permission
+// bits of the first concatenated file that exists. Zip entries, and files left out
+// with --on-missing-file skip, do not count. Without such a file it does nothing.
+func copyFirstSourceMode(outputPath string, items []ConcatItem) error {
+	for _, item := range items {
+		if !item.IsFile {
+			continue
+		}
+		path := unescapeString(item.Value)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(item.BaseDir, path)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		return os.Chmod(outputPath, info.Mode().Perm())
+	}
+	return nil
+}
+
+// reverseItems reverses the order of the items written to each output file for
+// --concat-order reverse. The write-to items stay in place, so every item still goes
+// to the same file.
+func reverseItems(items []ConcatItem) {
+	start := 0
+	for i := 0; i <= len(items); i++ {
+		if i < len(items) && !items[i].IsWriteTo {
+			continue
+		}
+		for left, right := start, i-1; left < right; left, right = left+1, right-1 {
+			items[left], items[right] = items[right], items[left]
+		}
+		start = i + 1
+	}
+}
+
+// resolveOutputPath places a relative output path under --output-dir, if given. The
+// path is otherwise relative to the current directory, whichever file the output or
+// write-to command appears in.
+func resolveOutputPath(path string) string {
+	if outputDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(outputDir, path)
+}
+
+// createOutputFile creates or truncates an output file. When --output-mode is given,
+// the file's permissions are set to exactly that mode, even if the file already existed.
+func createOutputFile(path string) (*os.File, error) {
+	if outputDir != "" {
+		// Subdirectories of the output directory are created as needed.
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return nil, err
+		}
+	}
+	if atomicWrite {
+		pendingOutputs = append(pendingOutputs, path)
+		path += ".tmp"
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, outputPerm)
+	if err != nil {
+		return nil, err
+	}
+	if outputMode != "" {
+		if err := file.Chmod(outputPerm); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// parseSize parses a byte count such as 1048576, 512KB, 10MB or 1GB. The units are
+// binary (1KB = 1024 bytes) and case-insensitive, and the trailing B may be omitted.
+func parseSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	multiplier := int64(1)
+	for suffix, factor := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if trimmed, ok := strings.CutSuffix(number, suffix); ok {
+			number, multiplier = trimmed, factor
+			break
+		}
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(number), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * multiplier, nil
+}
+
+// commitPendingOutputs renames the temporary files written with --atomic to their
+// final paths once the run has succeeded.
+func commitPendingOutputs() error {
+	for i, path := range pendingOutputs {
+		if err := os.Rename(path+".tmp", path); err != nil {
+			pendingOutputs = pendingOutputs[i:]
+			discardPendingOutputs()
+			return fmt.Errorf("renaming output file %s: %w", path+".tmp", err)
+		}
+	}
+	pendingOutputs = nil
+	return nil
+}
+
+// discardPendingOutputs removes the temporary files written with --atomic after a
+// failed run, leaving any previous output in place.
+func discardPendingOutputs() {
+	for _, path := range pendingOutputs {
+		os.Remove(path + ".tmp")
+	}
+	pendingOutputs = nil
+}
+
+// countingWriter forwards writes to w and counts the bytes written. With a limit, a
+// write that would take the total past it is refused as a whole.
+type countingWriter struct {
+	w         io.Writer
+	n         int64
+	limit     int64 // 0 for no limit
+	overLimit bool  // A write was refused because of the limit
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.limit > 0 && c.n+int64(len(p)) > c.limit {
+		c.overLimit = true
+		return 0, errOutputTooLarge
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// lineEndingWriter normalizes "\n" and "\r\n" line endings to either "\n" or
+// "\r\n" while streaming. A '\r' at the end of a write is held back until the next
+// write (or Flush) shows whether it starts a "\r\n". A lone '\r' is kept as is.
+type lineEndingWriter struct {
+	w         io.Writer
+	crlf      bool
+	pendingCR bool
+}
+
+func (l *lineEndingWriter) Write(p []byte) (int, error) {
+	newline := []byte("\n")
+	if l.crlf {
+		newline = []byte("\r\n")
+	}
+	out := make([]byte, 0, len(p)+len(p)/8)
+	for _, b := range p {
+		if l.pendingCR {
+			l.pendingCR = false
+			if b == '\n' {
+				out = append(out, newline...)
+				continue
+			}
+			out = append(out, '\r')
+		}
+		switch b {
+		case '\r':
+			l.pendingCR = true
+		case '\n':
+			out = append(out, newline...)
+		default:
+			out = append(out, b)
+		}
+	}
+	if _, err := l.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes a '\r' held back by the last Write.
+func (l *lineEndingWriter) Flush() error {
+	if !l.pendingCR {
+		return nil
+	}
+	l.pendingCR = false
+	_, err := l.w.Write([]byte("\r"))
+	return err
 }
 
-func runConcat(outputWriter io.Writer, itemsToConcat []ConcatItem, parameters map[string]string) error {
+// writeManifest writes the items recorded by runConcat as an indented JSON array.
+func writeManifest(filename string, manifest []ManifestEntry) error {
+	if manifest == nil {
+		manifest = []ManifestEntry{} // An empty run is written as [] rather than null
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filename, append(data, '\n'), 0666)
+}
+
+// runConcat writes the items to outputWriter and, if manifest is not nil, appends an
+// entry for each item with the number of bytes it contributed.
+func runConcat(outputWriter io.Writer, itemsToConcat []ConcatItem, parameters map[string]string, manifest *[]ManifestEntry) (err error) {
+	primaryWriter := outputWriter
+	// echo adds stdout to an output file for --stdout-also. The output of --diff is
+	// compared rather than written, so it is not echoed.
+	echo := func(w io.Writer) io.Writer {
+		if !stdoutAlso || diffMode || w == os.Stdout {
+			return w
+		}
+		return io.MultiWriter(w, os.Stdout)
+	}
+	// All writes go through, with --line-endings, the normalizer, then the counter and
+	// the output buffer, so that the counter sees the bytes actually written. The
+	// buffer is reset to the new file with each 'write-to'.
+	buffered := bufio.NewWriterSize(echo(outputWriter), bufferSize)
+	counter := &countingWriter{w: buffered, limit: maxOutput}
+	defer func() {
+		// Whichever item hit the limit, and however its error was wrapped, report the limit.
+		if counter.overLimit {
+			err = fmt.Errorf("%w of %d bytes", errOutputTooLarge, maxOutput)
+		}
+	}()
+	var normalizer *lineEndingWriter
+	if lineEndings != "" {
+		normalizer = &lineEndingWriter{w: counter, crlf: lineEndings == "crlf"}
+		outputWriter = normalizer
+	} else {
+		outputWriter = counter
+	}
+	var writeToFile *os.File // The file opened by the most recent 'write-to', if any
+	defer func() {
+		if writeToFile != nil {
+			writeToFile.Close()
+		}
+	}()
+	// On the error path, output written so far still reaches the target. On success
+	// the buffer has already been flushed and this does nothing.
+	defer buffered.Flush()
+
+	header, footer, err := outputFrame(parameters)
+	if err != nil {
+		return err
+	}
+	// writeFrame writes the header or footer, if any, to the current output file.
+	writeFrame := func(text string, entry ManifestEntry) error {
+		if text == "" {
+			return nil
+		}
+		written := counter.n
+		if _, err := io.WriteString(outputWriter, text); err != nil {
+			return fmt.Errorf("error writing %s to output: %v", entry.Type, err)
+		}
+		if manifest != nil {
+			entry.Bytes = counter.n - written
+			*manifest = append(*manifest, entry)
+		}
+		return nil
+	}
+	headerEntry := ManifestEntry{Type: "header", Path: filepath.ToSlash(headerFile)}
+	footerEntry := ManifestEntry{Type: "footer"}
+	if err := writeFrame(header, headerEntry); err != nil {
+		return err
+	}
+
 	for _, item := range itemsToConcat {
 		// Unescape special characters just before writing.
 		valueToWrite := unescapeString(item.Value)
-		if item.IsFile {
+		entry := ManifestEntry{Type: "text"}
+		written := counter.n
+		if item.IsWriteTo {
+			valueToWrite = resolveOutputPath(valueToWrite)
+			entry = ManifestEntry{Type: "write-to", Path: filepath.ToSlash(valueToWrite)}
+			if err := writeFrame(footer, footerEntry); err != nil {
+				return err
+			}
+			if normalizer != nil {
+				if err := normalizer.Flush(); err != nil {
+					return fmt.Errorf("error writing text to output: %v", err)
+				}
+			}
+			if err := buffered.Flush(); err != nil {
+				return fmt.Errorf("error writing to output: %v", err)
+			}
+			if writeToFile != nil {
+				if err := writeToFile.Close(); err != nil {
+					return fmt.Errorf("error closing output file %s: %v", writeToFile.Name(), err)
+				}
+				writeToFile = nil
+			}
+			newFile, err := createOutputFile(valueToWrite)
+			if err != nil {
+				return fmt.Errorf("error creating output file %s: %v", valueToWrite, err)
+			}
+			writeToFile = newFile
+			buffered.Reset(echo(newFile))
+			if manifest != nil {
+				*manifest = append(*manifest, ManifestEntry{Type: entry.Type, Path: entry.Path})
+			}
+			if err := writeFrame(header, headerEntry); err != nil {
+				return err
+			}
+			continue
+		} else if item.IsZip {
+			archivePath, pattern, _ := splitZipPath(valueToWrite)
+			if !filepath.IsAbs(archivePath) {
+				archivePath = filepath.Join(item.BaseDir, archivePath)
+			}
+			entry = ManifestEntry{Type: "zip", Path: filepath.ToSlash(archivePath) + ":" + pattern}
+			referencedFiles = append(referencedFiles, archivePath)
+			if err := copyZipEntries(outputWriter, archivePath, pattern); err != nil {
+				return err
+			}
+		} else if item.IsFile {
 			resolvedPath := valueToWrite
 			if !filepath.IsAbs(resolvedPath) {
 				resolvedPath = filepath.Join(item.BaseDir, resolvedPath)
 			}
+			entry = ManifestEntry{Type: "file", Path: filepath.ToSlash(resolvedPath)}
+			if item.IsBase64 {
+				entry.Type = "base64"
+			} else if item.IsTemplate {
+				entry.Type = "template"
+			} else if item.IsLiteral {
+				entry.Type = "sql-literal"
+			}
 
+			referencedFiles = append(referencedFiles, resolvedPath)
 			sourceFile, err := os.Open(resolvedPath)
+			if err != nil && onMissing == "skip" && errors.Is(err, fs.ErrNotExist) {
+				// Only a missing file is skipped; one that cannot be read is still an error.
+				printWarning("Warning: skipping missing file %s\n", resolvedPath)
+				continue
+			}
 			if err != nil {
 				return fmt.Errorf("error opening file %s: %v", resolvedPath, err)
 			}
-			defer sourceFile.Close()
+			// An empty file still gives a literal, '', which the SQL around it needs.
+			if skipEmpty && !item.IsLiteral {
+				info, err := sourceFile.Stat()
+				if err != nil {
+					sourceFile.Close()
+					return fmt.Errorf("error checking file %s: %v", resolvedPath, err)
+				}
+				if info.Size() == 0 {
+					sourceFile.Close()
+					continue
+				}
+			}
 
-			_, err = io.Copy(outputWriter, sourceFile)
+			if item.IsBase64 {
+				encoder := base64.NewEncoder(base64.StdEncoding, outputWriter)
+				_, err = io.Copy(encoder, sourceFile)
+				if err == nil {
+					err = encoder.Close() // Writes the final, padded block
+				}
+			} else if item.IsTemplate {
+				err = copyTemplate(outputWriter, sourceFile, parameters)
+			} else if item.IsLiteral {
+				err = copySQLLiteral(outputWriter, sourceFile)
+			} else if len(item.Filters) > 0 || len(item.Pipeline) > 0 || item.Head > 0 || item.Tail > 0 {
+				err = copyFilteredLines(outputWriter, sourceFile, item)
+			} else {
+				_, err = io.Copy(outputWriter, sourceFile)
+			}
+			// Closed right away rather than deferred, so that runs with thousands of
+			// files do not keep them all open until the end.
+			sourceFile.Close()
 			if err != nil {
 				return fmt.Errorf("error copying from %s: %v", resolvedPath, err)
 			}
+		} else if item.IsTempFile {
+			err := eachTempFileLine(item.Value, func(line string) error {
+				_, err := io.WriteString(outputWriter, unescapeString(line))
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("error writing text block from %s: %v", item.Value, err)
+			}
 		} else {
+			if item.IsTime {
+				valueToWrite = time.Now().Format(valueToWrite)
+				entry.Type = "timestamp"
+			}
 			_, err := outputWriter.Write([]byte(valueToWrite))
 			if err != nil {
 				return fmt.Errorf("error writing text to output: %v", err)
 			}
 		}
+		if manifest != nil {
+			entry.Bytes = counter.n - written
+			*manifest = append(*manifest, entry)
+		}
+	}
+	if err := writeFrame(footer, footerEntry); err != nil {
+		return err
+	}
+
+	if normalizer != nil {
+		if err := normalizer.Flush(); err != nil {
+			return fmt.Errorf("error writing text to output: %v", err)
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("error writing to output: %v", err)
+	}
+
+	if failOnEmpty && counter.n == 0 {
+		return errNoOutput
 	}
 
-	// No success message for stdout to avoid polluting output
-	if outputWriter != os.Stdout {
-		fmt.Fprintf(os.Stdout, "Successfully concatenated files to output.\n")
+	// No success message for stdout to avoid polluting output, with --quiet or for --diff
+	if primaryWriter != os.Stdout && !quietMode && !diffMode {
+		messageWriter := os.Stdout
+		if stdoutAlso {
+			messageWriter = os.Stderr // Kept apart from the echoed output
+		}
+		fmt.Fprintf(messageWriter, "Successfully concatenated files to output.\n")
 	}
 	return nil
 }
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeTestFile writes content to path, failing the test if it cannot.
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSubstituteParams(t *testing.T) {
+	parameters := map[string]string{
+		"NAME":    "users",
+		"SCHEMA":  "app",
+		"COLUMNS": "id, name, email",
+		"EMPTY":   "",
+		"COUNT":   "42",
+		"PRICE":   "3.14159",
+		"CUR":     "$",
+		"AMT":     "5",
+		"REF":     "${NAME}",
+	}
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"plain reference", "SELECT * FROM ${NAME};", "SELECT * FROM users;"},
+		{"several references", "DROP TABLE ${SCHEMA}.${NAME};", "DROP TABLE app.users;"},
+		{"undefined reference", "${MISSING}", "${MISSING}"},
+		{"escaped reference", "$${NAME} is ${NAME}", "$${NAME} is users"},
+		{"value ending in a dollar sign", "${CUR}${AMT}", "$5"},
+		{"value holding a reference", "${REF}", "${NAME}"},
+		{"reference inside an unknown one", "${X_${AMT}}", "${X_5}"},
+		{"empty value", "[${EMPTY}]", "[]"},
+		{"list element", "${COLUMNS[1]}", "name"},
+		{"list length", "${COLUMNS[#]}", "3"},
+		{"list index out of range", "[${COLUMNS[3]}]", "[]"},
+		{"substring offset", "${NAME:1}", "sers"},
+		{"substring offset and length", "${NAME:0:3}", "use"},
+		{"substring negative offset", "${NAME:-2}", "rs"},
+		{"substring past the end", "[${NAME:10:2}]", "[]"},
+		{"zero-padded integer", "${COUNT:%05d}", "00042"},
+		{"hexadecimal integer", "${COUNT:%#x}", "0x2a"},
+		{"float precision", "${PRICE:%.2f}", "3.14"},
+		{"integer formatted as float", "${COUNT:%.1f}", "42.0"},
+		{"padded string", "[${NAME:%-7s}]", "[users  ]"},
+		{"integer verb with a float", "${PRICE:%d}", "${PRICE:%d}"},
+		{"integer verb with text", "${NAME:%05d}", "${NAME:%05d}"},
+		{"unsupported verb", "${COUNT:%v}", "${COUNT:%v}"},
+		{"two verbs", "${COUNT:%d%d}", "${COUNT:%d%d}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := substituteParams(tt.input, parameters); got != tt.want {
+				t.Errorf("substituteParams(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateCondition(t *testing.T) {
+	parameters := map[string]string{
+		"ENV":     "prod",
+		"COUNT":   "10",
+		"VERSION": "1.10.0",
+		"NOTE":    "a (b) c",
+		"EXPR":    "x>=y",
+	}
+	tests := []struct {
+		condition string
+		want      bool
+		wantErr   bool
+	}{
+		{condition: "ENV=prod", want: true},
+		{condition: "ENV=dev", want: false},
+		{condition: "MISSING=prod", want: false},
+		{condition: "NOTE=a (b) c", want: true},
+		{condition: "EXPR=x>=y", want: true},
+		{condition: "COUNT>9", want: true},
+		{condition: "COUNT>=10", want: true},
+		{condition: "COUNT<10", want: false},
+		{condition: "ENV>1", want: false},
+		{condition: "VERSION>>1.9", want: true},
+		{condition: "VERSION<<=1.9.9", want: false},
+		{condition: "true", want: true},
+		{condition: "0", want: false},
+		{condition: "ENV=prod && COUNT>5", want: true},
+		{condition: "ENV=dev || COUNT<5", want: false},
+		{condition: "(ENV=dev || ENV=prod) && COUNT=10", want: true},
+		{condition: "ENV", wantErr: true},
+		{condition: "(ENV=prod && COUNT>5", wantErr: true},
+		{condition: "ENV=prod && COUNT>5)", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.condition, func(t *testing.T) {
+			got, err := evaluateCondition(tt.condition, parameters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("evaluateCondition(%q) error = %v, wantErr %v", tt.condition, err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("evaluateCondition(%q) = %v, want %v", tt.condition, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessInstructions(t *testing.T) {
+	tests := []struct {
+		name         string
+		instructions string
+		files        map[string]string // Further files in the instructions file's directory
+		parameters   map[string]string
+		wantOutput   string
+		wantItems    []ConcatItem // Only the IsFile and Value fields are compared
+		wantParams   map[string]string
+		wantErr      bool
+		wantKind     DSLErrorKind // With wantErr, the kind of the DSLError
+		wantLine     int          // With wantErr, the line of the DSLError
+		wantFile     string       // With wantErr, the base name of the DSLError's file; instructions.dsl if empty
+	}{
+		{
+			name:         "output and concat",
+			instructions: "output out.sql\nconcat a.sql\nemit -- done@@n\n",
+			wantOutput:   "out.sql",
+			wantItems:    []ConcatItem{{IsFile: true, Value: "a.sql"}, {Value: "-- done@@n"}},
+		},
+		{
+			name:         "if and else",
+			instructions: "param ENV=prod\nif ENV=prod\n    emit prod\nelse\n    emit dev\nendif\n",
+			wantItems:    []ConcatItem{{Value: "prod"}},
+		},
+		{
+			name:         "command-line parameter wins over param",
+			instructions: "param ENV=dev\nif ENV=prod\n    emit prod\nendif\n",
+			parameters:   map[string]string{"ENV": "prod"},
+			wantItems:    []ConcatItem{{Value: "prod"}},
+		},
+		{
+			name:         "set substitutes its value",
+			instructions: "param SCHEMA=app\nset TABLE=${SCHEMA}.users\nappend COLUMNS=id\nappend COLUMNS=name\n",
+			wantParams:   map[string]string{"SCHEMA": "app", "TABLE": "app.users", "COLUMNS": "id,name"},
+		},
+		{
+			name:         "repeat block",
+			instructions: "repeat 2\n    emit ${__ITER__}\nendrepeat\n",
+			wantItems:    []ConcatItem{{Value: "1"}, {Value: "2"}},
+		},
+		{
+			name:         "text block",
+			instructions: "text-begin\nline 1\nline 2\ntext-end\n",
+			wantItems:    []ConcatItem{{Value: "line 1\nline 2\n"}},
+		},
+		{
+			name:         "include",
+			instructions: "emit main\ninclude part.dsl\n",
+			files:        map[string]string{"part.dsl": "emit part\n"},
+			wantItems:    []ConcatItem{{Value: "main"}, {Value: "part"}},
+		},
+		{
+			name:         "unknown command",
+			instructions: "emit a\nfrobnicate\n",
+			wantErr:      true,
+			wantKind:     DSLErrorUnknownCommand,
+			wantLine:     2,
+		},
+		{
+			name:         "unclosed if",
+			instructions: "if A=1\nemit a\n",
+			wantErr:      true,
+			wantKind:     DSLErrorUnclosedBlock,
+			wantLine:     0, // Reported at the end of the file
+		},
+		{
+			name:         "unmatched endif",
+			instructions: "emit a\n\nendif\n",
+			wantErr:      true,
+			wantKind:     DSLErrorUnmatchedBlock,
+			wantLine:     3,
+		},
+		{
+			name:         "error in an included file",
+			instructions: "emit main\ninclude part.dsl\n",
+			files:        map[string]string{"part.dsl": "emit part\nelse\n"},
+			wantErr:      true,
+			wantKind:     DSLErrorUnmatchedBlock,
+			wantLine:     2,
+			wantFile:     "part.dsl",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			instructionsFile := filepath.Join(dir, "instructions.dsl")
+			writeTestFile(t, instructionsFile, tt.instructions)
+			for name, content := range tt.files {
+				writeTestFile(t, filepath.Join(dir, name), content)
+			}
+			parameters := make(map[string]string)
+			cliParamsSet = make(map[string]bool)
+			for name, value := range tt.parameters {
+				parameters[name] = value
+				cliParamsSet[name] = true
+			}
+			resetRunState()
+
+			var outputFile string
+			var items []ConcatItem
+			err := processInstructions(instructionsFile, &outputFile, &items, parameters, dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("processInstructions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				var dslErr *DSLError
+				if !errors.As(err, &dslErr) {
+					t.Fatalf("processInstructions() error = %v, want a DSLError", err)
+				}
+				wantFile := tt.wantFile
+				if wantFile == "" {
+					wantFile = "instructions.dsl"
+				}
+				if dslErr.Kind != tt.wantKind || dslErr.Line != tt.wantLine || filepath.Base(dslErr.File) != wantFile {
+					t.Errorf("DSLError = %s in %s line %d, want %s in %s line %d", dslErr.Kind, filepath.Base(dslErr.File), dslErr.Line, tt.wantKind, wantFile, tt.wantLine)
+				}
+				return
+			}
+			if outputFile != tt.wantOutput {
+				t.Errorf("output file = %q, want %q", outputFile, tt.wantOutput)
+			}
+			if tt.wantItems != nil {
+				var got []ConcatItem
+				for _, item := range items {
+					got = append(got, ConcatItem{IsFile: item.IsFile, Value: item.Value})
+				}
+				if !reflect.DeepEqual(got, tt.wantItems) {
+					t.Errorf("items = %+v, want %+v", got, tt.wantItems)
+				}
+			}
+			for name, want := range tt.wantParams {
+				if got := parameters[name]; got != want {
+					t.Errorf("parameter %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveLazyParams(t *testing.T) {
+	tests := []struct {
+		name       string
+		parameters map[string]string
+		lazy       []string
+		want       map[string]string
+		wantErr    bool
+	}{
+		{
+			name:       "chain",
+			parameters: map[string]string{"A": "${B}!", "B": "${C}", "C": "c"},
+			lazy:       []string{"A", "B"},
+			want:       map[string]string{"A": "c!", "B": "c"},
+		},
+		{
+			name:       "escaped reference to a lazy parameter",
+			parameters: map[string]string{"A": "$${B} and ${C}", "B": "b", "C": "c"},
+			lazy:       []string{"A", "B"},
+			want:       map[string]string{"A": "$${B} and c"},
+		},
+		{
+			name:       "cycle",
+			parameters: map[string]string{"A": "${B}", "B": "${A}"},
+			lazy:       []string{"A", "B"},
+			wantErr:    true,
+		},
+	}
+	t.Cleanup(func() { lazyParams = make(map[string]bool) })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lazyParams = make(map[string]bool)
+			for _, name := range tt.lazy {
+				lazyParams[name] = true
+			}
+			err := resolveLazyParams(tt.parameters)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveLazyParams() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for name, want := range tt.want {
+				if got := tt.parameters[name]; got != want {
+					t.Errorf("parameter %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckInputPath(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	writeTestFile(t, filepath.Join(dir, "secret.txt"), "secret")
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "sub", "a.sql"), "SELECT 1;")
+	resolvedRoot, err := resolveInputPath(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputRoot = resolvedRoot
+	t.Cleanup(func() { inputRoot = "" })
+	symlinkErr := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "link.txt"))
+
+	tests := []struct {
+		name    string
+		path    string
+		symlink bool // Skipped where symbolic links cannot be created
+		wantErr bool
+	}{
+		{name: "file inside", path: filepath.Join(root, "sub", "a.sql")},
+		{name: "root itself", path: root},
+		{name: "missing file inside", path: filepath.Join(root, "missing.sql")},
+		{name: "traversal back inside", path: filepath.Join(root, "sub", "..", "sub", "a.sql")},
+		{name: "traversal outside", path: root + string(filepath.Separator) + filepath.Join("..", "secret.txt"), wantErr: true},
+		{name: "sibling with the root as prefix", path: root + "2", wantErr: true},
+		{name: "symbolic link outside", path: filepath.Join(root, "link.txt"), symlink: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.symlink && symlinkErr != nil {
+				t.Skipf("cannot create symbolic link: %v", symlinkErr)
+			}
+			if err := checkInputPath(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("checkInputPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCopySQLLiteral(t *testing.T) {
+	tests := []struct {
+		dialect string
+		input   string
+		want    string
+	}{
+		{"standard", "", "''"},
+		{"standard", "it's", "'it''s'"},
+		{"standard", `C:\temp`, `'C:\temp'`},
+		{"standard", "a\nb", "'a\nb'"},
+		{"mysql", "it's", "'it''s'"},
+		{"mysql", `C:\temp`, `'C:\\temp'`},
+		{"mysql", "a\x00b", `'a\0b'`},
+	}
+	t.Cleanup(func() { sqlDialect = "standard" })
+	for _, tt := range tests {
+		t.Run(tt.dialect+" "+tt.input, func(t *testing.T) {
+			sqlDialect = tt.dialect
+			var b strings.Builder
+			if err := copySQLLiteral(&b, strings.NewReader(tt.input)); err != nil {
+				t.Fatal(err)
+			}
+			if got := b.String(); got != tt.want {
+				t.Errorf("copySQLLiteral(%q) with %s = %q, want %q", tt.input, tt.dialect, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestDiffLines checks on random inputs that the edit script of diffLines turns a
+// into b and is as short as the longest common subsequence allows.
+func TestDiffLines(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(12))
+		for i := range lines {
+			lines[i] = string(rune('a' + rng.Intn(3)))
+		}
+		return lines
+	}
+	for i := 0; i < 2000; i++ {
+		a, b := randomLines(), randomLines()
+		var gotA, gotB []string
+		edits := 0
+		for _, op := range diffLines(a, b) {
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+			if op.kind != ' ' {
+				edits++
+			}
+		}
+		if !slices.Equal(gotA, a) || !slices.Equal(gotB, b) {
+			t.Fatalf("diffLines(%q, %q) does not turn a into b", a, b)
+		}
+		if want := len(a) + len(b) - 2*lcsLength(a, b); edits != want {
+			t.Fatalf("diffLines(%q, %q) has %d edits, want %d", a, b, edits, want)
+		}
+	}
+}
+
+// lcsLength returns the length of the longest common subsequence of a and b.
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// BenchmarkRunConcat concatenates many small files into an output file, with an
+// output buffer of bufio's minimum size, which writes nearly every file on its own,
+// and with the default size.
+func BenchmarkRunConcat(b *testing.B) {
+	dir := b.TempDir()
+	var items []ConcatItem
+	for i := 0; i < 5000; i++ {
+		name := fmt.Sprintf("%04d.sql", i)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(fmt.Sprintf("INSERT INTO t VALUES (%d);\n", i)), 0644); err != nil {
+			b.Fatal(err)
+		}
+		items = append(items, ConcatItem{IsFile: true, Value: name, BaseDir: dir})
+	}
+	out, err := os.Create(filepath.Join(b.TempDir(), "out.sql"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	defer func(size int, quiet bool) { bufferSize, quietMode = size, quiet }(bufferSize, quietMode)
+	quietMode = true // runConcat reports each run
+	for _, size := range []int{16, defaultBufferSize} {
+		b.Run(fmt.Sprintf("buffer=%d", size), func(b *testing.B) {
+			bufferSize = size
+			for i := 0; i < b.N; i++ {
+				resetRunState()
+				if _, err := out.Seek(0, io.SeekStart); err != nil {
+					b.Fatal(err)
+				}
+				if err := runConcat(out, items, map[string]string{}, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// FuzzEvaluateCondition checks that evaluateCondition does not panic, and that a
+// comparison gives the same result alone, in parentheses and combined with itself.
+// A condition KEY=VALUE, where KEY holds no operator, must compare the whole of VALUE.
+func FuzzEvaluateCondition(f *testing.F) {
+	f.Add("COUNT>=10", "COUNT", "10")
+	f.Add("VERSION>>1.9", "VERSION", "1.10.0")
+	f.Add("ENV=prod && (COUNT>5 || DEBUG=1)", "ENV", "prod")
+	f.Add("A=x>=y", "A", "x>=y")
+	f.Add("=", "", "")
+	f.Add("N<-1e3", "N", "-1e3x")
+	f.Fuzz(func(t *testing.T, condition string, key string, value string) {
+		parameters := map[string]string{key: value}
+		got, err := evaluateCondition(condition, parameters)
+		again, againErr := evaluateCondition(condition, parameters)
+		if got != again || (err == nil) != (againErr == nil) {
+			t.Fatalf("evaluateCondition(%q) is not deterministic", condition)
+		}
+
+		if err == nil && condition == strings.TrimSpace(condition) && !strings.ContainsAny(condition, "&|()") {
+			for _, combined := range []string{"(" + condition + ")", condition + " && " + condition, condition + " || " + condition} {
+				if combinedGot, err := evaluateCondition(combined, parameters); err != nil || combinedGot != got {
+					t.Errorf("evaluateCondition(%q) = %v, %v; want %v as for %q", combined, combinedGot, err, got, condition)
+				}
+			}
+		}
+
+		if key != "" && !strings.ContainsAny(key, "=<>&|()") {
+			comparison := key + "=" + value
+			switch strings.TrimSpace(comparison) {
+			case "true", "false", "1", "0":
+				return
+			}
+			if strings.Contains(comparison, "&&") || strings.Contains(comparison, "||") || strings.HasPrefix(strings.TrimSpace(comparison), "(") {
+				return
+			}
+			if got, err := evaluateCondition(comparison, parameters); err != nil || !got {
+				t.Errorf("evaluateCondition(%q) = %v, %v; want true", comparison, got, err)
+			}
+		}
+	})
+}
@@ -1,3 +1,10 @@
 module db-concat
 
 go 1.22.0
+
+require (
+	github.com/fsnotify/fsnotify v1.8.0
+	golang.org/x/term v0.13.0
+)
+
+require golang.org/x/sys v0.13.0 // indirect
@@ -0,0 +1,3 @@
+SELECT id,name,created_at FROM users; -- 3 columns, the second is name
+-- step 1 - step 2 - step 3
+-- from-cli
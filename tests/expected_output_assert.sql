@@ -0,0 +1 @@
+port 8080
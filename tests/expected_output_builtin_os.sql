@@ -0,0 +1 @@
+-- Windows branch
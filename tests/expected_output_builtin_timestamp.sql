@@ -0,0 +1,2 @@
+UNIX_OK
+-- Generated: fixed layout
\ No newline at end of file
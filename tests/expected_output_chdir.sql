@@ -0,0 +1,8 @@
+SELECT a;
+SELECT b;
+-- a_dir/one.sql
+-- included file
+-- root.sql
+-- back in the main file
+-- a_dir/one.sql
+-- z_last.sql
@@ -0,0 +1,4 @@
+-- users
+SELECT a;
+SELECT 1 ;
+-- a#b ; kept
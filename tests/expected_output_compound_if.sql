@@ -0,0 +1,4 @@
+grouped
+and before or
+or after and
+nested
@@ -0,0 +1,6 @@
+SELECT a;
+SELECT b;
+--
+SELECT a;
+SELECT b;
+not sql
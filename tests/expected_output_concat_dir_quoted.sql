@@ -0,0 +1,4 @@
+SELECT 'spaces';
+SELECT 'spaces';
+SELECT a;
+SELECT b;
@@ -0,0 +1,14 @@
+-- strip-comments | trim-blank-lines
+create table Users (id int);
+insert into Users values ('a -- b', '/* c */');
+
+select 1  + 2;
+-- uppercase with grep
+/* GENERATED
+   BY A TOOL */
+CREATE TABLE USERS (ID INT); -- PRIMARY
+INSERT INTO USERS VALUES ('A -- B', '/* C */');
+
+SELECT 1 /* INLINE */ + 2;
+-- lowercase
+select a;
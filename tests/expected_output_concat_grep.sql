@@ -0,0 +1,6 @@
+CREATE TABLE vendor_items (id INT);
+CREATE INDEX vendor_items_idx ON vendor_items (id);
+DROP TABLE vendor_tmp;
+
+CREATE INDEX vendor_items_idx ON vendor_items (id);
+SELECT 'spaces';
\ No newline at end of file
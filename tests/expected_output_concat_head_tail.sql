@@ -0,0 +1,15 @@
+-- head 3
+INSERT INTO t VALUES (1);
+INSERT INTO t VALUES (2);
+INSERT INTO t VALUES (3);
+-- tail 2
+INSERT INTO t VALUES (9);
+INSERT INTO t VALUES (10);
+-- head 6 tail 2
+INSERT INTO t VALUES (5);
+INSERT INTO t VALUES (6);
+-- head 100 of a shorter file
+SELECT a;
+-- tail 4 then grep
+insert into t values (7);
+insert into t values (9);
@@ -0,0 +1,4 @@
+-- last
+SELECT b;
+SELECT a;
+-- first
@@ -0,0 +1,7 @@
+-- schema final
+CREATE TABLE final.users (id INT);
+-- literal ${SCHEMA}
+${UNDEFINED}
+-- schema ${SCHEMA}
+CREATE TABLE ${SCHEMA}.users (id INT);@@n-- literal $${SCHEMA}
+${UNDEFINED}
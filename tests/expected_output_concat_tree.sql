@@ -0,0 +1,11 @@
+-- root.sql
+-- z_last.sql
+-- a_dir/one.sql
+-- b_dir/two.sql
+-- b_dir/inner/three.sql
+==
+-- a_dir/one.sql
+-- b_dir/inner/three.sql
+-- b_dir/two.sql
+-- root.sql
+-- z_last.sql
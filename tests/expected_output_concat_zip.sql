@@ -0,0 +1,3 @@
+Bundle readme
+CREATE TABLE t (id INT);
+INSERT INTO t VALUES (1);
@@ -0,0 +1 @@
+hello from config
\ No newline at end of file
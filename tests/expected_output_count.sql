@@ -0,0 +1,3 @@
+sql files: 2
+no matches
+several
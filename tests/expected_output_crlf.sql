@@ -0,0 +1,3 @@
+-- users
+SELECT * FROM users;
+matched
@@ -0,0 +1,4 @@
+/*
+Licensed under the MIT License.
+Copyright Example Corp.
+*/
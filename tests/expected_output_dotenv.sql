@@ -0,0 +1,4 @@
+CREATE DATABASE orders;
+CREATE USER 'app user'@'db.internal';
+-- say "hi"
+-- single quotes keep \n as is
@@ -0,0 +1 @@
+SELECT * FROM app.users_view;
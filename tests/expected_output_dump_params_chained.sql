@@ -0,0 +1 @@
+-- DEV: reading from app.users_view
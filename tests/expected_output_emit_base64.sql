@@ -0,0 +1,2 @@
+-- certificate
+AAEC//5EQi1DT05DQVQKgA==
@@ -0,0 +1,4 @@
+emit: 2
+emit-now: 1
+emit: 2
+emit-now: 2
@@ -0,0 +1,2 @@
+-- Zone: UTC
+-- Layout from a parameter set later: UTC (Z)
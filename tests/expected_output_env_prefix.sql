@@ -0,0 +1,3 @@
+CREATE SCHEMA app;
+-- owner: admin
+-- unrelated: ${UNRELATED}
@@ -0,0 +1,6 @@
+${NAME} is app
+${NAME} now
+${NAME}-app
+SELECT '${NAME}' AS placeholder;
+SELECT ${NAME} FROM $${NAME};
+${__FILE__} ${X} at line 10
@@ -0,0 +1,2 @@
+-- version: vhello-1
+-- emitted: emitted directly
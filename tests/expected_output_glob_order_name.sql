@@ -0,0 +1,6 @@
+-- file02
+-- file1
+-- file10
+-- file2
+-- part10/a
+-- part2/a
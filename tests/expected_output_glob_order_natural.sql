@@ -0,0 +1,6 @@
+-- file1
+-- file2
+-- file02
+-- file10
+-- part2/a
+-- part10/a
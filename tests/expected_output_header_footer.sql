@@ -0,0 +1,3 @@
+-- shop: generated, do not edit
+SELECT 1;
+-- end of shop
@@ -0,0 +1,3 @@
+-- shop: generated, do not edit
+SELECT 2;
+-- end of shop
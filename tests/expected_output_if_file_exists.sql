@@ -0,0 +1,3 @@
+INSERT INTO users VALUES (1);
+-- fixtures/missing.sql skipped
+SELECT 'spaces';
\ No newline at end of file
@@ -0,0 +1,4 @@
+true
+false
+one
+combined
@@ -0,0 +1,6 @@
+-- start
+-- 01_schema
+-- ----
+-- 02_data sees TABLES=users
+INSERT INTO users VALUES (1);
+-- end
@@ -0,0 +1,3 @@
+-- start
+-- local override
+-- end
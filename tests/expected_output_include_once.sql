@@ -0,0 +1,3 @@
+-- common
+-- users
+-- orders
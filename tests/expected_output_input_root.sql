@@ -0,0 +1,3 @@
+-- inside the input root
+-- included part
+SELECT 1;
@@ -0,0 +1,6 @@
+SELECT 1;
+SELECT 2;
+SELECT 3;
+lonecr
+split
+end
\ No newline at end of file
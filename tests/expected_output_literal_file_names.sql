@@ -0,0 +1,2 @@
+-- text is still substituted: fixtures/concat_dir/a.sql
+SELECT a;
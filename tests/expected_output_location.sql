@@ -0,0 +1,4 @@
+tests/instructions_location.dsl:1
+included at line 2
+at 5
+tests/instructions_location.dsl:3
\ No newline at end of file
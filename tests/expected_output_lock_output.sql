@@ -0,0 +1,2 @@
+-- main file owns the output
+-- body from an included file
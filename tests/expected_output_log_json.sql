@@ -0,0 +1 @@
+-- logged
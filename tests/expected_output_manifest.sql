@@ -0,0 +1,5 @@
+-- header
+SELECT 1;
+SELECT 2;
+SELECT 3;
+AAEC//5EQi1DT05DQVQKgA==
\ No newline at end of file
@@ -0,0 +1 @@
+done
@@ -0,0 +1,100 @@
+INSERT INTO t VALUES (1);
+INSERT INTO t VALUES (2);
+INSERT INTO t VALUES (3);
+INSERT INTO t VALUES (4);
+INSERT INTO t VALUES (5);
+INSERT INTO t VALUES (6);
+INSERT INTO t VALUES (7);
+INSERT INTO t VALUES (8);
+INSERT INTO t VALUES (9);
+INSERT INTO t VALUES (10);
+INSERT INTO t VALUES (11);
+INSERT INTO t VALUES (12);
+INSERT INTO t VALUES (13);
+INSERT INTO t VALUES (14);
+INSERT INTO t VALUES (15);
+INSERT INTO t VALUES (16);
+INSERT INTO t VALUES (17);
+INSERT INTO t VALUES (18);
+INSERT INTO t VALUES (19);
+INSERT INTO t VALUES (20);
+INSERT INTO t VALUES (21);
+INSERT INTO t VALUES (22);
+INSERT INTO t VALUES (23);
+INSERT INTO t VALUES (24);
+INSERT INTO t VALUES (25);
+INSERT INTO t VALUES (26);
+INSERT INTO t VALUES (27);
+INSERT INTO t VALUES (28);
+INSERT INTO t VALUES (29);
+INSERT INTO t VALUES (30);
+INSERT INTO t VALUES (31);
+INSERT INTO t VALUES (32);
+INSERT INTO t VALUES (33);
+INSERT INTO t VALUES (34);
+INSERT INTO t VALUES (35);
+INSERT INTO t VALUES (36);
+INSERT INTO t VALUES (37);
+INSERT INTO t VALUES (38);
+INSERT INTO t VALUES (39);
+INSERT INTO t VALUES (40);
+INSERT INTO t VALUES (41);
+INSERT INTO t VALUES (42);
+INSERT INTO t VALUES (43);
+INSERT INTO t VALUES (44);
+INSERT INTO t VALUES (45);
+INSERT INTO t VALUES (46);
+INSERT INTO t VALUES (47);
+INSERT INTO t VALUES (48);
+INSERT INTO t VALUES (49);
+INSERT INTO t VALUES (50);
+INSERT INTO t VALUES (51);
+INSERT INTO t VALUES (52);
+INSERT INTO t VALUES (53);
+INSERT INTO t VALUES (54);
+INSERT INTO t VALUES (55);
+INSERT INTO t VALUES (56);
+INSERT INTO t VALUES (57);
+INSERT INTO t VALUES (58);
+INSERT INTO t VALUES (59);
+INSERT INTO t VALUES (60);
+INSERT INTO t VALUES (61);
+INSERT INTO t VALUES (62);
+INSERT INTO t VALUES (63);
+INSERT INTO t VALUES (64);
+INSERT INTO t VALUES (65);
+INSERT INTO t VALUES (66);
+INSERT INTO t VALUES (67);
+INSERT INTO t VALUES (68);
+INSERT INTO t VALUES (69);
+INSERT INTO t VALUES (70);
+INSERT INTO t VALUES (71);
+INSERT INTO t VALUES (72);
+INSERT INTO t VALUES (73);
+INSERT INTO t VALUES (74);
+INSERT INTO t VALUES (75);
+INSERT INTO t VALUES (76);
+INSERT INTO t VALUES (77);
+INSERT INTO t VALUES (78);
+INSERT INTO t VALUES (79);
+INSERT INTO t VALUES (80);
+INSERT INTO t VALUES (81);
+INSERT INTO t VALUES (82);
+INSERT INTO t VALUES (83);
+INSERT INTO t VALUES (84);
+INSERT INTO t VALUES (85);
+INSERT INTO t VALUES (86);
+INSERT INTO t VALUES (87);
+INSERT INTO t VALUES (88);
+INSERT INTO t VALUES (89);
+INSERT INTO t VALUES (90);
+INSERT INTO t VALUES (91);
+INSERT INTO t VALUES (92);
+INSERT INTO t VALUES (93);
+INSERT INTO t VALUES (94);
+INSERT INTO t VALUES (95);
+INSERT INTO t VALUES (96);
+INSERT INTO t VALUES (97);
+INSERT INTO t VALUES (98);
+INSERT INTO t VALUES (99);
+INSERT INTO t VALUES (100);
@@ -0,0 +1 @@
+-- part in a subdirectory
@@ -0,0 +1 @@
+CREATE USER app PASSWORD 's3cret';
\ No newline at end of file
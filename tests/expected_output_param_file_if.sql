@@ -0,0 +1,2 @@
+-- schema app, log level error
+-- region loaded
@@ -0,0 +1 @@
+-- app warn eu
@@ -0,0 +1 @@
+/data/import|/data/import/archive
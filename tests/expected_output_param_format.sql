@@ -0,0 +1,4 @@
+INSERT INTO orders (batch, seq, rate) VALUES ('0007-1', 1, 0.19);
+INSERT INTO orders (batch, seq, rate) VALUES ('0007-2', 2, 0.19);
+INSERT INTO orders (batch, seq, rate) VALUES ('0007-3', 3, 0.19);
+-- ${NAME:%d} is left as is, as orders is not a number
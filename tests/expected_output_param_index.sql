@@ -0,0 +1,3 @@
+first=alpha second=beta count=3
+empty count=0 missing=[] literal=${HOSTS[x]}
+last=gamma
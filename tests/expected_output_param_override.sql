@@ -0,0 +1,2 @@
+-- host=localhost token=local-secret name=app
+-- url=postgres://localhost/app
@@ -0,0 +1,3 @@
+first8=orders_a from7=archive_2024 last4=2024 negative-length=orders_archive
+clamped=[] [ord] [] unicode=éllo literal=${TABLE:x}
+short=idx_orders_arc
@@ -0,0 +1,4 @@
+#!/bin/sh
+# Applies the generated schema
+psql -f schema.sql
+SELECT a;
@@ -0,0 +1,3 @@
+-- ALPHA=first
+-- ZETA=last
+ALPHA: first; MIDDLE: added later; ZETA: last; 
\ No newline at end of file
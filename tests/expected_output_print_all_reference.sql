@@ -0,0 +1,6 @@
+-- ESCAPED=${NAME}_db
+-- NAME=app
+-- PENDING=${LATER}
+ESCAPED app ${NAME}
+NAME app ${NAME}
+PENDING app ${NAME}
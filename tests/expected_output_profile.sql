@@ -0,0 +1,2 @@
+-- profile: prod
+-- connecting to db.prod.example.com
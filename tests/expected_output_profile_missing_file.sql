@@ -0,0 +1 @@
+-- profile: staging
@@ -0,0 +1,5 @@
+SELECT 'spaces';
+a b c
+say "hi"
+don't
+WHERE name = 'bob' AND 'x' = "y"
\ No newline at end of file
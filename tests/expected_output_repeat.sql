@@ -0,0 +1,9 @@
+INSERT INTO t VALUES (1);
+-- skipped row 2
+INSERT INTO t VALUES (3);
+-- endrepeat inside a text block is just text
+-- endrepeat inside a text block is just text
+outer 1
+-- endrepeat inside a text block is just text
+-- endrepeat inside a text block is just text
+outer 2
@@ -0,0 +1,4 @@
+CREATE TABLE app.users (id int);
+INSERT INTO __SCHEMA__.users VALUES (1);
+GRANT SELECT, INSERT ON app.users TO ;
+-- __SCHEMA__ is not replaced after the replace command
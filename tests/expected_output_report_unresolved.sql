@@ -0,0 +1,3 @@
+SELECT * FROM users; -- ${TABLE_COMMENT}
+-- an escaped ${TABLE} is not reported
+-- ${ONE} and ${TWO[1]}
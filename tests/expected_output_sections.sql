@@ -0,0 +1,5 @@
+-- table users
+INSERT INTO users VALUES (1);
+-- end of users (footer defined in an included file)
+-- table orders
+-- (orders has a custom header)
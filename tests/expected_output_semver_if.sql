@@ -0,0 +1,2 @@
+GT_TRUE
+GTE_TRUE
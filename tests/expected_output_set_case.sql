@@ -0,0 +1,3 @@
+CREATE TABLE "ORDER_ITEMS" (id INT);
+CREATE INDEX order_items_idx ON "ORDER_ITEMS" (id);
+-- from_cli
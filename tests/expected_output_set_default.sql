@@ -0,0 +1 @@
+-- app@localhost:6543/cli-db?sslmode=disable,connect_timeout=6543
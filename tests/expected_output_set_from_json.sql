@@ -0,0 +1,2 @@
+db.example.com:5432 ssl=true replica=replica-2
+unprivileged
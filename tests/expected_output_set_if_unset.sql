@@ -0,0 +1 @@
+cli us cli.users
@@ -0,0 +1 @@
+app.users_v2|fixed
\ No newline at end of file
@@ -0,0 +1,3 @@
+SELECT a;
+-- empty.sql is empty
+SELECT b;
@@ -0,0 +1,3 @@
+INSERT INTO notes (body, extra) VALUES ('It''s a "quoted" note,
+with a backslash: C:\\temp\\new
+', '');
@@ -0,0 +1 @@
+CREATE USER admin PASSWORD 's3cret';
\ No newline at end of file
@@ -0,0 +1,3 @@
+DEV
+OTHER_REGION
+UNSET_DEFAULT
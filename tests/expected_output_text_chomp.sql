@@ -0,0 +1,2 @@
+GRANT SELECT ON app.orders,
+app.order_items TO reporting;
@@ -0,0 +1,9 @@
+-- A text block can now contain the line
+text-end
+-- and even a nested block:
+text-begin
+inner text
+text-end
+-- iteration 1: text-end
+-- iteration 2: text-end
+-- the default delimiter still works
@@ -0,0 +1,5 @@
+BEGIN
+    SELECT 1;
+      SELECT 2;
+
+END
@@ -0,0 +1,7 @@
+-- small block
+ok
+  SELECT * FROM users WHERE note = 'a	b';
+  SELECT '${TABLE}' AS escaped;
+
+  SELECT COUNT(1) FROM users; -- set after the block
+-- no newline after this line
@@ -0,0 +1,6 @@
+-- first line
+
+-- second line
+VALUE|keep   
+
+
@@ -0,0 +1,2 @@
+dev
+prefixed
@@ -0,0 +1,3 @@
+SELECT 1;
+value# stays because the hash does not follow whitespace
+"quoted # hash" #1
\ No newline at end of file
@@ -0,0 +1 @@
+still written
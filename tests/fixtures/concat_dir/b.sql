@@ -0,0 +1 @@
+SELECT b;
@@ -0,0 +1 @@
+-- a_dir/one.sql
@@ -0,0 +1 @@
+-- b_dir/inner/three.sql
@@ -0,0 +1 @@
+-- b_dir/two.sql
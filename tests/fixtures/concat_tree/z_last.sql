@@ -0,0 +1 @@
+-- z_last.sql
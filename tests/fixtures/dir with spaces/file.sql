@@ -0,0 +1 @@
+SELECT 'spaces';
\ No newline at end of file
@@ -0,0 +1 @@
+SELECT ${NAME} FROM $${NAME};
@@ -0,0 +1,9 @@
+
+-- Vendor schema
+/* generated
+   by a tool */
+create table Users (id int); -- primary
+insert into Users values ('a -- b', '/* c */');
+
+select 1 /* inline */ + 2;
+
@@ -0,0 +1 @@
+-- ${PROJECT}: generated, do not edit
@@ -0,0 +1 @@
+-- file10
@@ -0,0 +1 @@
+-- file2
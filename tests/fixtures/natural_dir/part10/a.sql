@@ -0,0 +1 @@
+-- part10/a
@@ -0,0 +1 @@
+-- part2/a
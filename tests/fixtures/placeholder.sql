@@ -0,0 +1 @@
+INSERT INTO __SCHEMA__.users VALUES (1);
@@ -0,0 +1,3 @@
+#!/bin/sh
+# Applies the generated schema
+psql -f schema.sql
@@ -0,0 +1 @@
+INSERT INTO users VALUES (1);
@@ -0,0 +1,3 @@
+-- schema ${SCHEMA}
+CREATE TABLE ${SCHEMA}.users (id INT);@@n-- literal $${SCHEMA}
+${UNDEFINED}
@@ -0,0 +1,10 @@
+INSERT INTO t VALUES (1);
+INSERT INTO t VALUES (2);
+INSERT INTO t VALUES (3);
+INSERT INTO t VALUES (4);
+INSERT INTO t VALUES (5);
+INSERT INTO t VALUES (6);
+INSERT INTO t VALUES (7);
+INSERT INTO t VALUES (8);
+INSERT INTO t VALUES (9);
+INSERT INTO t VALUES (10);
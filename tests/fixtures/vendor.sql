@@ -0,0 +1,8 @@
+-- Generated by VendorTool 4.2
+-- Do not edit
+
+CREATE TABLE vendor_items (id INT);
+
+-- Index
+CREATE INDEX vendor_items_idx ON vendor_items (id);
+DROP TABLE vendor_tmp;
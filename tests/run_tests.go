@@ -2,44 +2,94 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strings"
 )
 
 type testCase struct {
-	name          string
-	instructions  string
-	output        string
-	expected      string
-	args          []string
-	shouldFail    bool
-	stdoutFile    string
-	stderrFile    string
-	expectedError string
+	name           string
+	instructions   string
+	output         string
+	expected       string
+	args           []string
+	stdin          string
+	env            []string // Extra environment variables (KEY=value) for the run
+	shouldFail     bool
+	stdoutFile     string
+	stderrFile     string
+	expectedError  string
+	exitCode       int               // Expected exit status of a failing run, checked when set
+	expectedStderr string            // Text that must appear in stderr of a successful run
+	extraOutputs   map[string]string // Additional output files to compare, mapped to their expected files
+	outputMode     os.FileMode       // Expected permissions of the output file, checked when set (not on Windows)
+	exact          bool              // Compare the output byte for byte instead of ignoring carriage returns
+	silent         bool              // Expect nothing on stdout and stderr of a successful run
+	absentFiles    []string          // Files that must not exist after the run, whether it fails or not
 }
 
 func main() {
+	executablePath, err := buildExecutable(".")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tests := testCases()
+	failedTests := 0
+	for _, tc := range tests {
+		fmt.Printf("\n--- Test: %s ---\n", tc.name)
+		if err := runTestCase(executablePath, tc); err != nil {
+			fmt.Printf("Test FAILED: %s\n", err)
+			failedTests++
+		} else if tc.shouldFail {
+			fmt.Println("Test PASSED. (Expected error occurred)")
+		} else {
+			fmt.Println("Test PASSED.")
+		}
+	}
+
+	fmt.Println("\n--- Test Summary ---")
+	fmt.Printf("Total tests: %d\n", len(tests))
+	fmt.Printf("Failed tests: %d\n", failedTests)
+
+	fmt.Println("\nCleaning up generated test output files...")
+	// cleanup()
+
+	if failedTests > 0 {
+		os.Exit(1)
+	}
+}
+
+// buildExecutable builds db-concat into dir and returns the path to run it by.
+func buildExecutable(dir string) (string, error) {
 	executableName := "db-concat"
 	if runtime.GOOS == "windows" {
 		executableName = "db-concat.exe"
 	}
-	executablePath := ".\\" + executableName
-	if runtime.GOOS != "windows" {
-		executablePath = "./" + executableName
+	executablePath := filepath.Join(dir, executableName)
+	if !filepath.IsAbs(executablePath) {
+		// exec.Command only looks in the current directory for a path with a separator
+		executablePath = "." + string(filepath.Separator) + executablePath
 	}
 
 	fmt.Println("Building db-concat...")
 	buildCmd := exec.Command("go", "build", "-o", executablePath, ".")
 	buildOutput, err := buildCmd.CombinedOutput()
 	if err != nil {
-		fmt.Printf("Build failed: %s\n%s", err, string(buildOutput))
-		os.Exit(1)
+		return "", fmt.Errorf("Build failed: %s\n%s", err, string(buildOutput))
 	}
+	return executablePath, nil
+}
 
-	tests := []testCase{
+// testCases returns the end-to-end cases. Paths are relative to the repository root,
+// which must be the current directory when they run.
+func testCases() []testCase {
+	return []testCase{
 		{
 			name:         "Parameter Files (--param-file)",
 			instructions: "tests/instructions_param_file.dsl",
@@ -157,111 +207,1330 @@ func main() {
 			output:       "tests/output_numerical_if.sql",
 			expected:     "tests/expected_output_numerical_if.sql",
 		},
+		{
+			name:         "write-to command",
+			instructions: "tests/instructions_write_to.dsl",
+			output:       "tests/output_write_to.sql",
+			expected:     "tests/expected_output_write_to.sql",
+			extraOutputs: map[string]string{
+				"tests/output_write_to_part1.sql": "tests/expected_output_write_to_part1.sql",
+				"tests/output_write_to_part2.sql": "tests/expected_output_write_to_part2.sql",
+			},
+		},
+		{
+			name:         "Trailing comments on command lines",
+			instructions: "tests/instructions_trailing_comment.dsl",
+			output:       "tests/output_trailing_comment.sql",
+			expected:     "tests/expected_output_trailing_comment.sql",
+		},
+		{
+			name:         "Quoted arguments",
+			instructions: "tests/instructions_quoting.dsl",
+			output:       "tests/output_quoting.sql",
+			expected:     "tests/expected_output_quoting.sql",
+		},
+		{
+			name:         "text-begin trim and chomp options",
+			instructions: "tests/instructions_text_trim.dsl",
+			output:       "tests/output_text_trim.sql",
+			expected:     "tests/expected_output_text_trim.sql",
+		},
+		{
+			name:         "text-begin indent option",
+			instructions: "tests/instructions_text_indent.dsl",
+			output:       "tests/output_text_indent.sql",
+			expected:     "tests/expected_output_text_indent.sql",
+		},
+		{
+			name:         "Parameters from stdin (--stdin-param)",
+			instructions: "tests/instructions_stdin_param.dsl",
+			output:       "tests/output_stdin_param.sql",
+			expected:     "tests/expected_output_stdin_param.sql",
+			args:         []string{"--stdin-param", "DB_USER", "--stdin-param", "DB_PASSWORD"},
+			stdin:        "admin\r\ns3cret\n",
+		},
+		{
+			name:         "Config file (--config)",
+			instructions: "tests/instructions_config.dsl",
+			output:       "tests/output_config.sql",
+			expected:     "tests/expected_output_config.sql",
+			args:         []string{"--config", "tests/config_test.conf"},
+		},
+		{
+			name:         "Timestamp builtin parameters",
+			instructions: "tests/instructions_builtin_timestamp.dsl",
+			output:       "tests/output_builtin_timestamp.sql",
+			expected:     "tests/expected_output_builtin_timestamp.sql",
+			args:         []string{"--timestamp-format", "fixed layout"},
+		},
+		{
+			name:          "Builtin parameters are read-only",
+			instructions:  "tests/instructions_builtin_readonly.dsl",
+			output:        "tests/output_error_builtin_readonly.sql",
+			shouldFail:    true,
+			expectedError: "cannot modify builtin parameter __DATE__",
+		},
+		{
+			name:         "__FILE__ and __LINE__ builtins",
+			instructions: "tests/instructions_location.dsl",
+			output:       "tests/output_location.sql",
+			expected:     "tests/expected_output_location.sql",
+		},
+		{
+			name:         "repeat command",
+			instructions: "tests/instructions_repeat.dsl",
+			output:       "tests/output_repeat.sql",
+			expected:     "tests/expected_output_repeat.sql",
+		},
+		{
+			name:          "Unclosed repeat block",
+			instructions:  "tests/instructions_unclosed_repeat.dsl",
+			output:        "tests/output_error_unclosed_repeat.sql",
+			shouldFail:    true,
+			expectedError: "repeat without a matching endrepeat",
+		},
+		{
+			name:         "concat-dir command",
+			instructions: "tests/instructions_concat_dir.dsl",
+			output:       "tests/output_concat_dir.sql",
+			expected:     "tests/expected_output_concat_dir.sql",
+		},
+		{
+			name:          "concat-dir with no matching files",
+			instructions:  "tests/instructions_concat_dir_empty.dsl",
+			output:        "tests/output_error_concat_dir_empty.sql",
+			shouldFail:    true,
+			expectedError: "no files to concatenate in directory",
+		},
+		{
+			name:         "concat-tree command",
+			instructions: "tests/instructions_concat_tree.dsl",
+			output:       "tests/output_concat_tree.sql",
+			expected:     "tests/expected_output_concat_tree.sql",
+		},
+		{
+			name:          "Empty output with --fail-on-empty-output",
+			instructions:  "tests/instructions_empty_output.dsl",
+			output:        "tests/output_error_empty_output.sql",
+			args:          []string{"--fail-on-empty-output"},
+			shouldFail:    true,
+			expectedError: "no output was written",
+		},
+		{
+			name:         "switch command",
+			instructions: "tests/instructions_switch.dsl",
+			output:       "tests/output_switch.sql",
+			expected:     "tests/expected_output_switch.sql",
+		},
+		{
+			name:          "switch with a command before the first case",
+			instructions:  "tests/instructions_switch_invalid.dsl",
+			output:        "tests/output_error_switch_invalid.sql",
+			shouldFail:    true,
+			expectedError: "command before the first case in switch",
+		},
+		{
+			name:         "Version if conditions",
+			instructions: "tests/instructions_semver_if.dsl",
+			output:       "tests/output_semver_if.sql",
+			expected:     "tests/expected_output_semver_if.sql",
+		},
+		{
+			name:          "Version if condition with an invalid version",
+			instructions:  "tests/instructions_semver_invalid.dsl",
+			output:        "tests/output_error_semver_invalid.sql",
+			shouldFail:    true,
+			expectedError: "invalid version",
+		},
+		{
+			name:         "Output file permissions (--output-mode)",
+			instructions: "tests/instructions_output_mode.dsl",
+			output:       "tests/output_output_mode.sql",
+			expected:     "tests/expected_output_output_mode.sql",
+			args:         []string{"--output-mode", "0600", "--param", "DB_PASSWORD=s3cret"},
+			outputMode:   0600,
+		},
+		{
+			name:         "set-lazy command",
+			instructions: "tests/instructions_set_lazy.dsl",
+			output:       "tests/output_set_lazy.sql",
+			expected:     "tests/expected_output_set_lazy.sql",
+		},
+		{
+			name:          "Circular set-lazy references",
+			instructions:  "tests/instructions_set_lazy_cycle.dsl",
+			output:        "tests/output_error_set_lazy_cycle.sql",
+			shouldFail:    true,
+			expectedError: "circular reference in lazy parameter",
+		},
+		{
+			name:         "print-all command",
+			instructions: "tests/instructions_print_all.dsl",
+			output:       "tests/output_print_all.sql",
+			expected:     "tests/expected_output_print_all.sql",
+		},
+		{
+			name:         "Line ending normalization (--line-endings crlf)",
+			instructions: "tests/instructions_line_endings.dsl",
+			output:       "tests/output_line_endings_crlf.sql",
+			expected:     "tests/expected_output_line_endings_crlf.sql",
+			args:         []string{"--line-endings", "crlf"},
+			exact:        true,
+		},
+		{
+			name:         "Line ending normalization (--line-endings lf)",
+			instructions: "tests/instructions_line_endings.dsl",
+			output:       "tests/output_line_endings_lf.sql",
+			expected:     "tests/expected_output_line_endings_lf.sql",
+			args:         []string{"--line-endings", "lf"},
+			exact:        true,
+		},
+		{
+			name:         "emit-base64 command",
+			instructions: "tests/instructions_emit_base64.dsl",
+			output:       "tests/output_emit_base64.sql",
+			expected:     "tests/expected_output_emit_base64.sql",
+		},
+		{
+			name:          "abort command",
+			instructions:  "tests/instructions_abort.dsl",
+			output:        "tests/output_error_abort.sql",
+			shouldFail:    true,
+			expectedError: "aborted: legacy-auth cannot be enabled in prod",
+		},
+		{
+			name:           "warn command",
+			instructions:   "tests/instructions_warn.dsl",
+			output:         "tests/output_warn.sql",
+			expected:       "tests/expected_output_warn.sql",
+			expectedStderr: "Warning: old_indexes is deprecated",
+		},
+		{
+			name:          "warn command with --werror",
+			instructions:  "tests/instructions_warn.dsl",
+			output:        "tests/output_error_warn.sql",
+			args:          []string{"--werror"},
+			shouldFail:    true,
+			expectedError: "warning treated as error: old_indexes is deprecated",
+		},
+		{
+			name:         ".env parameter files (--dotenv)",
+			instructions: "tests/instructions_dotenv.dsl",
+			output:       "tests/output_dotenv.sql",
+			expected:     "tests/expected_output_dotenv.sql",
+			args:         []string{"--dotenv", "tests/params.env"},
+		},
+		{
+			name:         "JSON manifest (--manifest)",
+			instructions: "tests/instructions_manifest.dsl",
+			output:       "tests/output_manifest.sql",
+			expected:     "tests/expected_output_manifest.sql",
+			args:         []string{"--manifest", "tests/output_manifest.json"},
+			extraOutputs: map[string]string{
+				"tests/output_manifest.json": "tests/expected_output_manifest.json",
+			},
+		},
+		{
+			name:         "Many files are closed as they are copied",
+			instructions: "tests/instructions_many_files.dsl",
+			output:       "tests/output_many_files.sql",
+			expected:     "tests/expected_output_many_files.sql",
+		},
+		{
+			name:         "write-to command with a small output buffer (--buffer-size)",
+			instructions: "tests/instructions_write_to.dsl",
+			output:       "tests/output_write_to.sql",
+			expected:     "tests/expected_output_write_to.sql",
+			args:         []string{"--buffer-size", "4"},
+			extraOutputs: map[string]string{
+				"tests/output_write_to_part1.sql": "tests/expected_output_write_to_part1.sql",
+				"tests/output_write_to_part2.sql": "tests/expected_output_write_to_part2.sql",
+			},
+		},
+		{
+			name:         "Glob order by name (default)",
+			instructions: "tests/instructions_glob_order.dsl",
+			output:       "tests/output_glob_order_name.sql",
+			expected:     "tests/expected_output_glob_order_name.sql",
+		},
+		{
+			name:         "Glob order natural (--glob-order natural)",
+			instructions: "tests/instructions_glob_order.dsl",
+			output:       "tests/output_glob_order_natural.sql",
+			expected:     "tests/expected_output_glob_order_natural.sql",
+			args:         []string{"--glob-order", "natural"},
+		},
+		{
+			name:         "include-if-exists command",
+			instructions: "tests/instructions_include_if_exists.dsl",
+			output:       "tests/output_include_if_exists.sql",
+			expected:     "tests/expected_output_include_if_exists.sql",
+		},
+		{
+			name:          "include-if-exists with an invalid file",
+			instructions:  "tests/instructions_include_if_exists_invalid.dsl",
+			output:        "tests/output_error_include_if_exists.sql",
+			shouldFail:    true,
+			expectedError: "unknown command: not-a-command",
+		},
+		{
+			name:         "Wildcard include",
+			instructions: "tests/instructions_include_glob.dsl",
+			output:       "tests/output_include_glob.sql",
+			expected:     "tests/expected_output_include_glob.sql",
+		},
+		{
+			name:          "Wildcard include without matches",
+			instructions:  "tests/instructions_include_glob_empty.dsl",
+			output:        "tests/output_error_include_glob.sql",
+			shouldFail:    true,
+			expectedError: "no files match include pattern fixtures/snippets/*.missing",
+		},
+		{
+			name:         "Environment variables with a prefix (--env-prefix)",
+			instructions: "tests/instructions_env_prefix.dsl",
+			output:       "tests/output_env_prefix.sql",
+			expected:     "tests/expected_output_env_prefix.sql",
+			args:         []string{"--env-prefix", "DBCONCAT_"},
+			env:          []string{"DBCONCAT_OWNER=admin", "DBCONCAT_SCHEMA=app", "UNRELATED=x"},
+		},
+		{
+			name:         "exec command (--allow-exec)",
+			instructions: "tests/instructions_exec.dsl",
+			output:       "tests/output_exec.sql",
+			expected:     "tests/expected_output_exec.sql",
+			args:         []string{"--allow-exec"},
+		},
+		{
+			name:          "exec command without --allow-exec",
+			instructions:  "tests/instructions_exec.dsl",
+			output:        "tests/output_error_exec_not_allowed.sql",
+			shouldFail:    true,
+			expectedError: "exec requires the --allow-exec flag",
+		},
+		{
+			name:          "exec command that fails",
+			instructions:  "tests/instructions_exec_failure.dsl",
+			output:        "tests/output_error_exec_failure.sql",
+			args:          []string{"--allow-exec"},
+			shouldFail:    true,
+			expectedError: "exit status 3: schema missing",
+		},
+		{
+			name:         "set-upper and set-lower commands",
+			instructions: "tests/instructions_set_case.dsl",
+			output:       "tests/output_set_case.sql",
+			expected:     "tests/expected_output_set_case.sql",
+			args:         []string{"--param", "LOCKED=from_cli"},
+		},
+		{
+			name:          "set-lower with an undefined parameter",
+			instructions:  "tests/instructions_set_case_undefined.dsl",
+			output:        "tests/output_error_set_case.sql",
+			shouldFail:    true,
+			expectedError: "set-lower: undefined parameter UNDEFINED_PARAM",
+		},
+		{
+			name:         "if-file-exists condition",
+			instructions: "tests/instructions_if_file_exists.dsl",
+			output:       "tests/output_if_file_exists.sql",
+			expected:     "tests/expected_output_if_file_exists.sql",
+		},
+		{
+			name:         "Dump final parameters (--dump-params)",
+			instructions: "tests/instructions_dump_params.dsl",
+			output:       "tests/output_dump_params.sql",
+			expected:     "tests/expected_output_dump_params.sql",
+			args:         []string{"--param", "ENV=dev", "--dump-params", "tests/output_dump_params.txt"},
+			extraOutputs: map[string]string{
+				"tests/output_dump_params.txt": "tests/expected_output_dump_params.txt",
+			},
+		},
+		{
+			name:         "Dumped parameters as a parameter file",
+			instructions: "tests/instructions_dump_params_chained.dsl",
+			output:       "tests/output_dump_params_chained.sql",
+			expected:     "tests/expected_output_dump_params_chained.sql",
+			args:         []string{"--param-file", "tests/expected_output_dump_params.txt"},
+		},
+		{
+			name:         "define-section and use-section commands",
+			instructions: "tests/instructions_sections.dsl",
+			output:       "tests/output_sections.sql",
+			expected:     "tests/expected_output_sections.sql",
+		},
+		{
+			name:          "Section that uses itself",
+			instructions:  "tests/instructions_section_recursive.dsl",
+			output:        "tests/output_error_section_recursive.sql",
+			shouldFail:    true,
+			expectedError: "section LOOP uses itself",
+		},
+		{
+			name:         "emit-now command",
+			instructions: "tests/instructions_emit_now.dsl",
+			output:       "tests/output_emit_now.sql",
+			expected:     "tests/expected_output_emit_now.sql",
+		},
+		{
+			name:         "text-begin chomp without a trailing newline",
+			instructions: "tests/instructions_text_chomp.dsl",
+			output:       "tests/output_text_chomp.sql",
+			expected:     "tests/expected_output_text_chomp.sql",
+		},
+		{
+			name:         "concat with grep line filters",
+			instructions: "tests/instructions_concat_grep.dsl",
+			output:       "tests/output_concat_grep.sql",
+			expected:     "tests/expected_output_concat_grep.sql",
+		},
+		{
+			name:         "Output directory (--output-dir)",
+			instructions: "tests/instructions_output_dir.dsl",
+			output:       "tests/output_dir_build/main.sql",
+			expected:     "tests/expected_output_output_dir_main.sql",
+			args:         []string{"--output-dir", "tests/output_dir_build"},
+			extraOutputs: map[string]string{
+				"tests/output_dir_build/reports/part.sql": "tests/expected_output_output_dir_part.sql",
+			},
+		},
+		{
+			name:         "@include in parameter files",
+			instructions: "tests/instructions_param_file_include.dsl",
+			output:       "tests/output_param_file_include.sql",
+			expected:     "tests/expected_output_param_file_include.sql",
+			args:         []string{"--param-file", "tests/params/prod.txt"},
+		},
+		{
+			name:          "Parameter file that includes itself",
+			instructions:  "tests/instructions_param_file_include.dsl",
+			output:        "tests/output_error_param_file_include.sql",
+			args:          []string{"--param-file", "tests/params/cycle.txt"},
+			shouldFail:    true,
+			expectedError: "includes itself",
+		},
+		{
+			name:          "Colored errors (--color always)",
+			instructions:  "tests/instructions_unclosed_if.dsl",
+			output:        "tests/output_error_color.sql",
+			args:          []string{"--color", "always"},
+			shouldFail:    true,
+			expectedError: "\x1b[31mError processing instructions: unclosed if block(s)\x1b[0m\n",
+		},
+		{
+			name:           "Colored warnings (--color always)",
+			instructions:   "tests/instructions_warn.dsl",
+			output:         "tests/output_warn_color.sql",
+			expected:       "tests/expected_output_warn.sql",
+			args:           []string{"--color", "always"},
+			expectedStderr: "\x1b[33mWarning: old_indexes is deprecated\x1b[0m\n",
+		},
+		{
+			name:          "Uncolored errors (--color never)",
+			instructions:  "tests/instructions_unknown_command.dsl",
+			output:        "tests/output_error_color_never.sql",
+			args:          []string{"--color", "never"},
+			shouldFail:    true,
+			expectedError: "Error processing instructions: unknown command: unknown_cmd\n",
+		},
+		{
+			name:          "Exit status for invalid instructions",
+			instructions:  "tests/instructions_unknown_command.dsl",
+			output:        "tests/output_error_exit_instructions.sql",
+			shouldFail:    true,
+			expectedError: "unknown command",
+			exitCode:      2,
+		},
+		{
+			name:          "Exit status for a missing file",
+			instructions:  "tests/instructions_missing_file.dsl",
+			output:        "tests/output_error_exit_io.sql",
+			shouldFail:    true,
+			expectedError: "error opening file",
+			exitCode:      3,
+		},
+		{
+			name:          "Exit status for a missing parameter file",
+			instructions:  "tests/instructions_emit.dsl",
+			output:        "tests/output_error_exit_failure.sql",
+			args:          []string{"--param-file", "tests/does_not_exist.txt"},
+			shouldFail:    true,
+			expectedError: "error opening parameter file",
+			exitCode:      1,
+		},
+		{
+			name:         "set-if-unset command",
+			instructions: "tests/instructions_set_if_unset.dsl",
+			output:       "tests/output_set_if_unset.sql",
+			expected:     "tests/expected_output_set_if_unset.sql",
+			args:         []string{"--param", "SCHEMA=cli"},
+		},
+		{
+			name:         "concat-zip command",
+			instructions: "tests/instructions_concat_zip.dsl",
+			output:       "tests/output_concat_zip.sql",
+			expected:     "tests/expected_output_concat_zip.sql",
+		},
+		{
+			name:          "concat-zip without a matching entry",
+			instructions:  "tests/instructions_concat_zip_missing.dsl",
+			output:        "tests/output_error_concat_zip.sql",
+			shouldFail:    true,
+			expectedError: "no entry matching nothing/*.sql in archive",
+		},
+		{
+			name:         "concat-dir with --since in the past",
+			instructions: "tests/instructions_concat_dir.dsl",
+			output:       "tests/output_concat_dir_since.sql",
+			expected:     "tests/expected_output_concat_dir.sql",
+			args:         []string{"--since", "2000-01-01T00:00:00Z"},
+		},
+		{
+			name:         "concat-tree with --since as a duration",
+			instructions: "tests/instructions_concat_tree.dsl",
+			output:       "tests/output_concat_tree_since.sql",
+			expected:     "tests/expected_output_concat_tree.sql",
+			args:         []string{"--since", "876000h"},
+		},
+		{
+			name:          "concat-dir with --until excluding every file",
+			instructions:  "tests/instructions_concat_dir.dsl",
+			output:        "tests/output_error_concat_dir_until.sql",
+			args:          []string{"--until", "2000-01-01T00:00:00Z"},
+			shouldFail:    true,
+			expectedError: "no files to concatenate in directory",
+		},
+		{
+			name:          "Invalid --since value",
+			instructions:  "tests/instructions_concat_dir.dsl",
+			output:        "tests/output_error_since.sql",
+			args:          []string{"--since", "yesterday"},
+			shouldFail:    true,
+			expectedError: "invalid --since yesterday",
+		},
+		{
+			name:         "Escaped parameter references",
+			instructions: "tests/instructions_escaped_reference.dsl",
+			output:       "tests/output_escaped_reference.sql",
+			expected:     "tests/expected_output_escaped_reference.sql",
+		},
+		{
+			name:           "Tracing commands with --trace",
+			instructions:   "tests/instructions_trace.dsl",
+			output:         "tests/output_trace.sql",
+			expected:       "tests/expected_output_trace.sql",
+			args:           []string{"--trace"},
+			expectedStderr: "instructions_trace.dsl:3: emit prod@@n [skipped depth=1 prefix=\"\"]",
+		},
+		{
+			name:         "Compound if conditions",
+			instructions: "tests/instructions_compound_if.dsl",
+			output:       "tests/output_compound_if.sql",
+			expected:     "tests/expected_output_compound_if.sql",
+		},
+		{
+			name:          "Unbalanced parentheses in an if condition",
+			instructions:  "tests/instructions_unbalanced_condition.dsl",
+			output:        "tests/output_error_unbalanced_condition.sql",
+			shouldFail:    true,
+			expectedError: "unbalanced parentheses in condition: (A=1 || A=2",
+		},
+		{
+			name:         "NUL byte escape (@@0)",
+			instructions: "tests/instructions_nul_separator.dsl",
+			output:       "tests/output_nul_separator.sql",
+			expected:     "tests/expected_output_nul_separator.sql",
+			exact:        true,
+		},
+		{
+			name:         "assert command",
+			instructions: "tests/instructions_assert.dsl",
+			output:       "tests/output_assert.sql",
+			expected:     "tests/expected_output_assert.sql",
+		},
+		{
+			name:          "Failed assert with a message",
+			instructions:  "tests/instructions_assert_failed.dsl",
+			output:        "tests/output_error_assert_failed.sql",
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "assertion failed: PORT 80 is reserved",
+		},
+		{
+			name:          "Failed assert without a message",
+			instructions:  "tests/instructions_assert_no_message.dsl",
+			output:        "tests/output_error_assert_no_message.sql",
+			shouldFail:    true,
+			expectedError: "assertion failed: ENV=prod",
+		},
+		{
+			name:         "Instructions file with CRLF line endings",
+			instructions: "tests/instructions_crlf.dsl",
+			output:       "tests/output_crlf.sql",
+			expected:     "tests/expected_output_crlf.sql",
+			exact:        true,
+		},
+		{
+			name:           "Missing file skipped with --on-missing-file skip",
+			instructions:   "tests/instructions_missing_file.dsl",
+			output:         "tests/output_missing_file.sql",
+			expected:       "tests/expected_output_missing_file.sql",
+			args:           []string{"--on-missing-file", "skip"},
+			expectedStderr: "Warning: skipping missing file",
+		},
+		{
+			name:          "Missing file is an error by default",
+			instructions:  "tests/instructions_missing_file.dsl",
+			output:        "tests/output_error_missing_file.sql",
+			shouldFail:    true,
+			exitCode:      3,
+			expectedError: "error opening file",
+		},
+		{
+			name:         "Header and footer (--header-file, --footer-text)",
+			instructions: "tests/instructions_header_footer.dsl",
+			output:       "tests/output_header_footer.sql",
+			expected:     "tests/expected_output_header_footer.sql",
+			args:         []string{"--header-file", "tests/fixtures/header.sql", "--footer-text", "-- end of ${PROJECT}@@n"},
+			extraOutputs: map[string]string{
+				"tests/output_header_footer_part.sql": "tests/expected_output_header_footer_part.sql",
+			},
+		},
+		{
+			name:         "count command",
+			instructions: "tests/instructions_count.dsl",
+			output:       "tests/output_count.sql",
+			expected:     "tests/expected_output_count.sql",
+		},
+		{
+			name:         "concat-template command",
+			instructions: "tests/instructions_concat_template.dsl",
+			output:       "tests/output_concat_template.sql",
+			expected:     "tests/expected_output_concat_template.sql",
+		},
+		{
+			name:         "Parameter from a file (--define-from-file)",
+			instructions: "tests/instructions_define_from_file.dsl",
+			output:       "tests/output_define_from_file.sql",
+			expected:     "tests/expected_output_define_from_file.sql",
+			args:         []string{"--define-from-file", "LICENSE=tests/fixtures/license.txt"},
+		},
+		{
+			name:          "Missing file for --define-from-file",
+			instructions:  "tests/instructions_define_from_file.dsl",
+			output:        "tests/output_error_define_from_file.sql",
+			args:          []string{"--define-from-file", "LICENSE=tests/fixtures/no_such_license.txt"},
+			shouldFail:    true,
+			expectedError: "Error in --define-from-file",
+		},
+		{
+			name:         "No messages or warnings with --quiet",
+			instructions: "tests/instructions_missing_file.dsl",
+			output:       "tests/output_quiet.sql",
+			expected:     "tests/expected_output_missing_file.sql",
+			args:         []string{"--quiet", "--on-missing-file", "skip"},
+			silent:       true,
+		},
+		{
+			name:         "set-from-json command",
+			instructions: "tests/instructions_set_from_json.dsl",
+			output:       "tests/output_set_from_json.sql",
+			expected:     "tests/expected_output_set_from_json.sql",
+		},
+		{
+			name:          "set-from-json selecting an object",
+			instructions:  "tests/instructions_set_from_json_object.dsl",
+			output:        "tests/output_error_set_from_json.sql",
+			shouldFail:    true,
+			expectedError: "$.database selects an object or array, not a single value",
+		},
+		{
+			name:         "Atomic output (--atomic)",
+			instructions: "tests/instructions_write_to.dsl",
+			output:       "tests/output_atomic.sql",
+			expected:     "tests/expected_output_write_to.sql",
+			args:         []string{"--atomic"},
+			extraOutputs: map[string]string{
+				"tests/output_write_to_part1.sql": "tests/expected_output_write_to_part1.sql",
+				"tests/output_write_to_part2.sql": "tests/expected_output_write_to_part2.sql",
+			},
+			absentFiles: []string{"tests/output_atomic.sql.tmp", "tests/output_write_to_part1.sql.tmp", "tests/output_write_to_part2.sql.tmp"},
+		},
+		{
+			name:          "Failed run with --atomic leaves no output",
+			instructions:  "tests/instructions_missing_file.dsl",
+			output:        "tests/output_error_atomic.sql",
+			args:          []string{"--atomic"},
+			shouldFail:    true,
+			expectedError: "error opening file",
+			absentFiles:   []string{"tests/output_error_atomic.sql", "tests/output_error_atomic.sql.tmp"},
+		},
+		{
+			name:         "Output within --max-output-size",
+			instructions: "tests/instructions_max_output_size.dsl",
+			output:       "tests/output_max_output_size.sql",
+			expected:     "tests/expected_output_max_output_size.sql",
+			args:         []string{"--max-output-size", "10MB"},
+		},
+		{
+			name:          "Output exceeding --max-output-size",
+			instructions:  "tests/instructions_max_output_size.dsl",
+			output:        "tests/output_error_max_output_size.sql",
+			args:          []string{"--max-output-size", "1KB"},
+			shouldFail:    true,
+			exitCode:      1,
+			expectedError: "output exceeds --max-output-size of 1024 bytes",
+		},
+		{
+			name:         "concat-dir and concat-tree with a quoted directory",
+			instructions: "tests/instructions_concat_dir_quoted.dsl",
+			output:       "tests/output_concat_dir_quoted.sql",
+			expected:     "tests/expected_output_concat_dir_quoted.sql",
+		},
+		{
+			name:          "Wildcard include that includes itself",
+			instructions:  "tests/instructions_include_cycle.dsl",
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "circular include: fixtures/include_cycle/a.dsl -> fixtures/include_cycle/b.dsl -> fixtures/include_cycle/a.dsl",
+			absentFiles:   []string{"tests/output_include_cycle.sql"},
+		},
+		{
+			name:          "include-glob that includes itself",
+			instructions:  "tests/instructions_include_glob_cycle.dsl",
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "circular include: fixtures/include_glob_cycle/part.dsl -> fixtures/include_glob_cycle/part.dsl",
+			absentFiles:   []string{"tests/output_include_glob_cycle.sql"},
+		},
+		{
+			name:         "print-all does not substitute the values again",
+			instructions: "tests/instructions_print_all_reference.dsl",
+			output:       "tests/output_print_all_reference.sql",
+			expected:     "tests/expected_output_print_all_reference.sql",
+		},
+		{
+			name:          "text block without its delimiter",
+			instructions:  "tests/instructions_text_unclosed.dsl",
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "text-begin without matching EOF",
+		},
+		{
+			name:          "--max-output-size counts the bytes after --line-endings",
+			instructions:  "tests/instructions_crlf_limit.dsl",
+			args:          []string{"--line-endings", "crlf", "--max-output-size", "8"},
+			shouldFail:    true,
+			exitCode:      1,
+			expectedError: "output exceeds --max-output-size of 8 bytes",
+		},
+		{
+			name:         "--manifest counts the bytes after --line-endings",
+			instructions: "tests/instructions_crlf_manifest.dsl",
+			output:       "tests/output_crlf_manifest.sql",
+			expected:     "tests/expected_output_crlf_manifest.sql",
+			args:         []string{"--line-endings", "crlf", "--manifest", "tests/output_crlf_manifest.json"},
+			exact:        true,
+			extraOutputs: map[string]string{
+				"tests/output_crlf_manifest.json": "tests/expected_output_crlf_manifest.json",
+			},
+		},
+		{
+			name:         "Substitution in parameter files (--param-file-substitute)",
+			instructions: "tests/instructions_param_file_substitute.dsl",
+			output:       "tests/output_param_file_substitute.sql",
+			expected:     "tests/expected_output_param_file_substitute.sql",
+			args:         []string{"--param-file-substitute", "--param-file", "tests/param_file_substitute.txt", "--dump-params", "tests/output_param_file_substitute.txt"},
+			extraOutputs: map[string]string{
+				"tests/output_param_file_substitute.txt": "tests/expected_output_param_file_substitute.txt",
+			},
+		},
+		{
+			name:         "Reverse item order (--concat-order reverse)",
+			instructions: "tests/instructions_concat_order.dsl",
+			output:       "tests/output_concat_order.sql",
+			expected:     "tests/expected_output_concat_order.sql",
+			args:         []string{"--concat-order", "reverse"},
+		},
+		{
+			name:         "Validating instructions (--validate)",
+			instructions: "tests/instructions_concat_order.dsl",
+			stdoutFile:   "tests/output_validate.txt",
+			expected:     "tests/expected_output_validate.txt",
+			args:         []string{"--validate", "--output", "tests/output_validate.sql"},
+			absentFiles:  []string{"tests/output_validate.sql"},
+		},
+		{
+			name:          "Validating instructions with a missing file",
+			instructions:  "tests/instructions_missing_file.dsl",
+			output:        "tests/output_error_validate_missing.sql",
+			args:          []string{"--validate"},
+			shouldFail:    true,
+			exitCode:      3,
+			expectedError: "Error validating: error checking file",
+			absentFiles:   []string{"tests/output_error_validate_missing.sql"},
+		},
+		{
+			name:          "Validating invalid instructions",
+			instructions:  "tests/instructions_unbalanced_condition.dsl",
+			output:        "tests/output_error_validate_invalid.sql",
+			args:          []string{"--validate"},
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "unbalanced parentheses in condition",
+		},
+		{
+			name:         "include-once command",
+			instructions: "tests/instructions_include_once.dsl",
+			output:       "tests/output_include_once.sql",
+			expected:     "tests/expected_output_include_once.sql",
+		},
+		{
+			name:         "Skipping empty files (--skip-empty-files, if-file-nonempty)",
+			instructions: "tests/instructions_skip_empty.dsl",
+			output:       "tests/output_skip_empty.sql",
+			expected:     "tests/expected_output_skip_empty.sql",
+			args:         []string{"--skip-empty-files", "--manifest", "tests/output_skip_empty.json"},
+			extraOutputs: map[string]string{
+				"tests/output_skip_empty.json": "tests/expected_output_skip_empty.json",
+			},
+		},
+		{
+			name:          "if-file-nonempty with a missing file",
+			instructions:  "tests/instructions_if_file_nonempty_missing.dsl",
+			output:        "tests/output_error_if_file_nonempty.sql",
+			shouldFail:    true,
+			exitCode:      3,
+			expectedError: "error checking file",
+		},
+		{
+			name:         "Literal if conditions",
+			instructions: "tests/instructions_if_literals.dsl",
+			output:       "tests/output_if_literals.sql",
+			expected:     "tests/expected_output_if_literals.sql",
+		},
+		{
+			name:         "Indexed parameter references",
+			instructions: "tests/instructions_param_index.dsl",
+			output:       "tests/output_param_index.sql",
+			expected:     "tests/expected_output_param_index.sql",
+		},
+		{
+			name:          "Index out of range with --index-out-of-range error",
+			instructions:  "tests/instructions_param_index.dsl",
+			output:        "tests/output_error_param_index.sql",
+			args:          []string{"--index-out-of-range", "error"},
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "index 5 out of range for parameter HOSTS with 3 elements",
+		},
+		{
+			name:         "Diff against an up-to-date output file (--diff)",
+			instructions: "tests/instructions_concat_order.dsl",
+			stdoutFile:   "tests/output_diff_same.txt",
+			expected:     "tests/fixtures/empty.sql",
+			args:         []string{"--diff", "--concat-order", "reverse", "--output", "tests/expected_output_concat_order.sql"},
+		},
+		{
+			name:         "Diff against an outdated output file (--diff)",
+			instructions: "tests/instructions_concat_order.dsl",
+			stdoutFile:   "tests/output_diff.txt",
+			expected:     "tests/expected_output_diff.txt",
+			args:         []string{"--diff", "--output", "tests/expected_output_concat_order.sql"},
+			shouldFail:   true,
+			exitCode:     4,
+		},
+		{
+			name:          "Diff without an output file",
+			instructions:  "tests/instructions_concat_order.dsl",
+			stdoutFile:    "tests/output_error_diff.txt",
+			args:          []string{"--diff"},
+			shouldFail:    true,
+			exitCode:      1,
+			expectedError: "--diff requires an output file",
+		},
+		{
+			name:         "Comment character (--comment-char)",
+			instructions: "tests/instructions_comment_char.dsl",
+			output:       "tests/output_comment_char.sql",
+			expected:     "tests/expected_output_comment_char.sql",
+			args:         []string{"--comment-char", ";", "--param-file", "tests/params/semicolon.txt"},
+		},
+		{
+			name:          "Collecting all errors (--keep-going)",
+			instructions:  "tests/instructions_keep_going.dsl",
+			output:        "tests/output_error_keep_going.sql",
+			args:          []string{"--keep-going"},
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "Error processing instructions: 4 error(s)",
+			absentFiles:   []string{"tests/output_error_keep_going.sql"},
+		},
+		{
+			name:          "Locations of errors collected by --keep-going",
+			instructions:  "tests/instructions_keep_going.dsl",
+			output:        "tests/output_error_keep_going_location.sql",
+			args:          []string{"--keep-going"},
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "tests/instructions_keep_going.dsl:6: assertion failed",
+		},
+		{
+			name:         "concat with named filters",
+			instructions: "tests/instructions_concat_filters.dsl",
+			output:       "tests/output_concat_filters.sql",
+			expected:     "tests/expected_output_concat_filters.sql",
+		},
+		{
+			name:         "emit-timestamp command",
+			instructions: "tests/instructions_emit_timestamp.dsl",
+			output:       "tests/output_emit_timestamp.sql",
+			expected:     "tests/expected_output_emit_timestamp.sql",
+			env:          []string{"TZ=UTC"},
+		},
+		{
+			name:          "Prompting for missing parameters without a terminal (--prompt-missing)",
+			instructions:  "tests/instructions_prompt_missing.dsl",
+			output:        "tests/output_error_prompt_missing.sql",
+			args:          []string{"--prompt-missing"},
+			shouldFail:    true,
+			exitCode:      1,
+			expectedError: "parameter DB_PASSWORD is not set (stdin is not a terminal",
+			absentFiles:   []string{"tests/output_error_prompt_missing.sql"},
+		},
+		{
+			name:         "Parameter override file (--param-override-file)",
+			instructions: "tests/instructions_param_override.dsl",
+			output:       "tests/output_param_override.sql",
+			expected:     "tests/expected_output_param_override.sql",
+			args:         []string{"--param", "DB_HOST=cli-host", "--param", "DB_NAME=app", "--param-override-file", "tests/params/override.txt"},
+		},
+		{
+			name:           "JSON log format for warnings and trace (--log-format json)",
+			instructions:   "tests/instructions_log_json.dsl",
+			output:         "tests/output_log_json.sql",
+			expected:       "tests/expected_output_log_json.sql",
+			args:           []string{"--log-format", "json", "--trace"},
+			expectedStderr: `{"depth":0,"file":"tests/instructions_log_json.dsl","level":"trace","line":2,"msg":"warn \"tables\" & <views> are not checked","prefix":"","status":"run"}` + "\n" + `{"level":"warn","msg":"\"tables\" & <views> are not checked"}` + "\n",
+		},
+		{
+			name:          "JSON log format for errors (--log-format json)",
+			instructions:  "tests/instructions_keep_going.dsl",
+			output:        "tests/output_error_log_json.sql",
+			args:          []string{"--log-format", "json", "--keep-going"},
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: `{"file":"tests/instructions_keep_going.dsl","level":"error","line":3,"msg":"unknown command: frobnicate"}`,
+		},
+		{
+			name:         "set-default command",
+			instructions: "tests/instructions_set_default.dsl",
+			output:       "tests/output_set_default.sql",
+			expected:     "tests/expected_output_set_default.sql",
+			args:         []string{"--param", "DB_NAME=cli-db", "--param", "DEFAULT_USER=app"},
+			env:          []string{"DBC_TEST_PORT=6543", "DBC_TEST_NAME=from-env"},
+		},
+		{
+			name:          "set-default without a value from any source",
+			instructions:  "tests/instructions_set_default.dsl",
+			output:        "tests/output_error_set_default.sql",
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "set-default: none of the sources for DB_USER has a value",
+		},
+		{
+			name:         "Include graph (--graph) with --validate",
+			instructions: "tests/instructions_include_once.dsl",
+			stdoutFile:   "tests/output_graph_validate.txt",
+			expected:     "tests/expected_output_validate.txt",
+			args:         []string{"--validate", "--graph", "tests/output_graph.dot", "--output", "tests/output_graph.sql"},
+			extraOutputs: map[string]string{"tests/output_graph.dot": "tests/expected_output_graph.dot"},
+			absentFiles:  []string{"tests/output_graph.sql"},
+		},
+		{
+			name:         "Substring parameter references",
+			instructions: "tests/instructions_param_substring.dsl",
+			output:       "tests/output_param_substring.sql",
+			expected:     "tests/expected_output_param_substring.sql",
+		},
+		{
+			name:         "Preserving the permissions of the first file (--preserve-permissions)",
+			instructions: "tests/instructions_preserve_permissions.dsl",
+			output:       "tests/output_preserve_permissions.sql",
+			expected:     "tests/expected_output_preserve_permissions.sql",
+			args:         []string{"--preserve-permissions"},
+			outputMode:   0755,
+		},
+		{
+			name:         "replace command",
+			instructions: "tests/instructions_replace.dsl",
+			output:       "tests/output_replace.sql",
+			expected:     "tests/expected_output_replace.sql",
+		},
+		{
+			name:           "__OS__ and __ARCH__ builtins",
+			instructions:   "tests/instructions_builtin_os.dsl",
+			output:         "tests/output_builtin_os.sql",
+			expected:       "tests/expected_output_builtin_os.sql",
+			args:           []string{"--param", "TARGET_OS=windows"},
+			expectedStderr: "Warning: running on " + runtime.GOOS + "/" + runtime.GOARCH + "\n",
+		},
+		{
+			name:          "__OS__ builtin is read-only",
+			instructions:  "tests/instructions_builtin_os.dsl",
+			output:        "tests/output_error_builtin_os.sql",
+			args:          []string{"--param", "__OS__=windows"},
+			shouldFail:    true,
+			exitCode:      1,
+			expectedError: "cannot modify builtin parameter __OS__",
+		},
+		{
+			name:         "concat with head and tail",
+			instructions: "tests/instructions_concat_head_tail.dsl",
+			output:       "tests/output_concat_head_tail.sql",
+			expected:     "tests/expected_output_concat_head_tail.sql",
+		},
+		{
+			name:         "profile loads its parameter file",
+			instructions: "tests/instructions_profile.dsl",
+			output:       "tests/output_profile.sql",
+			expected:     "tests/expected_output_profile.sql",
+			args:         []string{"--profile", "prod"},
+		},
+		{
+			name:         "profile without a parameter file",
+			instructions: "tests/instructions_profile.dsl",
+			output:       "tests/output_profile_missing_file.sql",
+			expected:     "tests/expected_output_profile_missing_file.sql",
+			args:         []string{"--profile", "staging"},
+		},
+		{
+			name:         "profile name with a path separator",
+			instructions: "tests/instructions_profile.dsl",
+			output:       "tests/output_profile_invalid.sql",
+			args:         []string{"--profile", "../prod"},
+			shouldFail:   true,
+		},
+		{
+			name:         "lock-output allows output in the main file",
+			instructions: "tests/instructions_lock_output.dsl",
+			output:       "tests/output_lock_output.sql",
+			expected:     "tests/expected_output_lock_output.sql",
+			args:         []string{"--lock-output"},
+		},
+		{
+			name:           "lock-output rejects output in an included file",
+			instructions:   "tests/instructions_lock_output_include.dsl",
+			output:         "tests/output_lock_output_include.sql",
+			args:           []string{"--lock-output"},
+			shouldFail:     true,
+			expectedStderr: "output elsewhere.sql is not allowed in an included file with --lock-output",
+			absentFiles:    []string{"tests/output_lock_output_include.sql"},
+		},
+		{
+			name:         "text-begin with a delimiter",
+			instructions: "tests/instructions_text_delimiter.dsl",
+			output:       "tests/output_text_delimiter.sql",
+			expected:     "tests/expected_output_text_delimiter.sql",
+		},
+		{
+			name:         "append to a parameter",
+			instructions: "tests/instructions_append.dsl",
+			output:       "tests/output_append.sql",
+			expected:     "tests/expected_output_append.sql",
+			args:         []string{"--param", "LOCKED=from-cli"},
+		},
+		{
+			name:         "text blocks kept in memory",
+			instructions: "tests/instructions_text_spill.dsl",
+			output:       "tests/output_text_spill_memory.sql",
+			expected:     "tests/expected_output_text_spill.sql",
+			exact:        true,
+		},
+		{
+			name:         "text blocks spilled to temporary files",
+			instructions: "tests/instructions_text_spill.dsl",
+			output:       "tests/output_text_spill.sql",
+			expected:     "tests/expected_output_text_spill.sql",
+			args:         []string{"--text-spill-size", "16"},
+			exact:        true,
+		},
+		{
+			name:         "substitute-file-names=false keeps paths literal",
+			instructions: "tests/instructions_literal_file_names.dsl",
+			output:       "tests/output_literal_file_names.sql",
+			expected:     "tests/expected_output_literal_file_names.sql",
+			args:         []string{"--substitute-file-names=false"},
+		},
+		{
+			name:          "substitute-file-names=false with a parameter in a path",
+			instructions:  "tests/instructions_literal_file_names_param.dsl",
+			output:        "tests/output_literal_file_names_param.sql",
+			args:          []string{"--substitute-file-names=false"},
+			shouldFail:    true,
+			exitCode:      3,
+			expectedError: "${FILE}",
+		},
+		{
+			name:          "substitute-file-names=false with an include in a section",
+			instructions:  "tests/instructions_literal_include_section.dsl",
+			args:          []string{"--substitute-file-names=false"},
+			shouldFail:    true,
+			exitCode:      3,
+			expectedError: "${PART}",
+		},
+		{
+			name:         "chdir changes the base directory",
+			instructions: "tests/instructions_chdir.dsl",
+			output:       "tests/output_chdir.sql",
+			expected:     "tests/expected_output_chdir.sql",
+		},
+		{
+			name:          "chdir to a missing directory",
+			instructions:  "tests/instructions_chdir_missing.dsl",
+			output:        "tests/output_chdir_missing.sql",
+			shouldFail:    true,
+			exitCode:      3,
+			expectedError: "error changing to directory",
+		},
+		{
+			name:         "report unresolved references",
+			instructions: "tests/instructions_report_unresolved.dsl",
+			output:       "tests/output_report_unresolved.sql",
+			expected:     "tests/expected_output_report_unresolved.sql",
+			args:         []string{"--report-unresolved", "tests/output_report_unresolved.txt", "--on-missing-file", "skip"},
+			extraOutputs: map[string]string{
+				"tests/output_report_unresolved.txt": "tests/expected_output_report_unresolved.txt",
+			},
+		},
+		{
+			name:         "param-file-if loads a parameter file when its condition holds",
+			instructions: "tests/instructions_param_file_if.dsl",
+			output:       "tests/output_param_file_if.sql",
+			expected:     "tests/expected_output_param_file_if.sql",
+		},
+		{
+			name:          "param-file-if with a missing file",
+			instructions:  "tests/instructions_param_file_if.dsl",
+			output:        "tests/output_param_file_if_missing.sql",
+			args:          []string{"--param", "ENV=dev"},
+			shouldFail:    true,
+			exitCode:      3,
+			expectedError: "error opening parameter file tests/params/no_such_file.txt",
+		},
+		{
+			name:           "stdout-also echoes the output file",
+			instructions:   "tests/instructions_chdir.dsl",
+			args:           []string{"--stdout-also", "--output", "tests/output_stdout_also.sql"},
+			stdoutFile:     "tests/output_stdout_also_echo.sql",
+			expected:       "tests/expected_output_chdir.sql",
+			expectedStderr: "Successfully concatenated files to output.",
+			extraOutputs: map[string]string{
+				"tests/output_stdout_also.sql": "tests/expected_output_chdir.sql",
+			},
+		},
+		{
+			name:         "printf-style formats in references",
+			instructions: "tests/instructions_param_format.dsl",
+			output:       "tests/output_param_format.sql",
+			expected:     "tests/expected_output_param_format.sql",
+		},
+		{
+			name:         "include-glob with a separator",
+			instructions: "tests/instructions_include_glob.dsl",
+			output:       "tests/output_include_glob.sql",
+			expected:     "tests/expected_output_include_glob.sql",
+		},
+		{
+			name:          "include-glob without a pattern",
+			instructions:  "tests/instructions_include_glob_invalid.dsl",
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "invalid include-glob command format",
+		},
+		{
+			name:         "input-root allows files inside the root",
+			instructions: "tests/fixtures/input_root/instructions.dsl",
+			output:       "tests/output_input_root.sql",
+			args:         []string{"--input-root", "tests/fixtures/input_root"},
+			expected:     "tests/expected_output_input_root.sql",
+		},
+		{
+			name:          "input-root rejects a concatenated file outside the root",
+			instructions:  "tests/fixtures/input_root/escape.dsl",
+			args:          []string{"--input-root", "tests/fixtures/input_root", "--param", "OUTSIDE=../../instructions_chdir.dsl"},
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "tests/instructions_chdir.dsl is outside the input root",
+		},
+		{
+			name:          "input-root rejects an include outside the root",
+			instructions:  "tests/fixtures/input_root/escape_include.dsl",
+			args:          []string{"--input-root", "tests/fixtures/input_root"},
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "is outside the input root",
+		},
+		{
+			name:          "input-root rejects include-if-exists of a missing file outside the root",
+			instructions:  "tests/fixtures/input_root/escape_if_exists.dsl",
+			args:          []string{"--input-root", "tests/fixtures/input_root"},
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "no_such_file.dsl is outside the input root",
+		},
+		{
+			name:         "concat-sql-literal quotes a file",
+			instructions: "tests/instructions_sql_literal.dsl",
+			output:       "tests/output_sql_literal.sql",
+			expected:     "tests/expected_output_sql_literal.sql",
+		},
+		{
+			name:         "concat-sql-literal with the mysql dialect",
+			instructions: "tests/instructions_sql_literal.dsl",
+			output:       "tests/output_sql_literal.sql",
+			args:         []string{"--sql-dialect", "mysql", "--skip-empty-files"},
+			expected:     "tests/expected_output_sql_literal_mysql.sql",
+		},
+		{
+			name:          "line holding only the prefix",
+			instructions:  "tests/instructions_prefix_only.dsl",
+			shouldFail:    true,
+			exitCode:      2,
+			expectedError: "unknown command: ",
+		},
+		{
+			name:         "concat options after a quoted path",
+			instructions: "tests/instructions_concat_quoted_options.dsl",
+			output:       "tests/output_concat_quoted_options.sql",
+			expected:     "tests/expected_output_concat_quoted_options.sql",
+		},
+		{
+			name:           "concat pipeline after a quoted path",
+			instructions:   "tests/instructions_concat_quoted_pipe.dsl",
+			output:         "tests/output_concat_quoted_pipe.sql",
+			args:           []string{"--on-missing-file", "skip"},
+			expected:       "tests/expected_output_concat_quoted_pipe.sql",
+			expectedStderr: "Warning: skipping missing file tests/fixtures/quoted/no | such file.sql",
+		},
 	}
+}
 
-	failedTests := 0
-	for _, tc := range tests {
-		fmt.Printf("\n--- Test: %s ---\n", tc.name)
-
-		var cmdArgs []string
-		if len(tc.args) > 0 {
-			cmdArgs = append(cmdArgs, tc.args...)
-		}
-		if tc.output != "" && tc.stdoutFile == "" {
-			cmdArgs = append(cmdArgs, "--output", tc.output)
-		}
-		cmdArgs = append(cmdArgs, tc.instructions)
+// runTestCase runs db-concat for one case and checks the outcome, returning an error
+// describing the first difference from what the case expects.
+func runTestCase(executablePath string, tc testCase) error {
+	var cmdArgs []string
+	if len(tc.args) > 0 {
+		cmdArgs = append(cmdArgs, tc.args...)
+	}
+	if tc.output != "" && tc.stdoutFile == "" {
+		cmdArgs = append(cmdArgs, "--output", tc.output)
+	}
+	cmdArgs = append(cmdArgs, tc.instructions)
 
-		cmd := exec.Command(executablePath, cmdArgs...)
+	cmd := exec.Command(executablePath, cmdArgs...)
+	if tc.stdin != "" {
+		cmd.Stdin = strings.NewReader(tc.stdin)
+	}
+	if len(tc.env) > 0 {
+		cmd.Env = append(os.Environ(), tc.env...)
+	}
 
-		var stdout, stderr bytes.Buffer
-		if tc.stdoutFile != "" {
-			outfile, err := os.Create(tc.stdoutFile)
-			if err != nil {
-				fmt.Printf("Failed to create stdout file: %s\n", err)
-				failedTests++
-				continue
-			}
-			defer outfile.Close()
-			cmd.Stdout = outfile
-		} else {
-			cmd.Stdout = &stdout
+	var stdout, stderr bytes.Buffer
+	if tc.stdoutFile != "" {
+		outfile, err := os.Create(tc.stdoutFile)
+		if err != nil {
+			return fmt.Errorf("failed to create stdout file: %s", err)
 		}
+		defer outfile.Close()
+		cmd.Stdout = outfile
+	} else {
+		cmd.Stdout = &stdout
+	}
 
-		if tc.stderrFile != "" {
-			errfile, err := os.Create(tc.stderrFile)
-			if err != nil {
-				fmt.Printf("Failed to create stderr file: %s\n", err)
-				failedTests++
-				continue
-			}
-			defer errfile.Close()
-			cmd.Stderr = errfile
-		} else {
-			cmd.Stderr = &stderr
+	if tc.stderrFile != "" {
+		errfile, err := os.Create(tc.stderrFile)
+		if err != nil {
+			return fmt.Errorf("failed to create stderr file: %s", err)
 		}
+		defer errfile.Close()
+		cmd.Stderr = errfile
+	} else {
+		cmd.Stderr = &stderr
+	}
 
-		err := cmd.Run()
+	err := cmd.Run()
 
-		if tc.shouldFail {
-			if err == nil {
-				fmt.Println("Test FAILED: Expected error, but got none.")
-				failedTests++
-			} else {
-				if tc.expectedError != "" {
-					var errorOutput []byte
-					var readErr error
-					if tc.stderrFile != "" {
-						errorOutput, readErr = os.ReadFile(tc.stderrFile)
-					} else {
-						errorOutput = stderr.Bytes()
-					}
+	if absentErr := checkAbsent(tc.absentFiles); absentErr != nil {
+		return absentErr
+	}
 
-					if readErr != nil {
-						fmt.Printf("Test FAILED: could not read stderr: %v\n", readErr)
-						failedTests++
-					} else if !bytes.Contains(errorOutput, []byte(tc.expectedError)) {
-						fmt.Printf("Test FAILED: Expected error message '%s' not found in stderr.\n", tc.expectedError)
-						failedTests++
-					} else {
-						fmt.Println("Test PASSED. (Expected error occurred)")
-					}
-				} else {
-					fmt.Println("Test PASSED. (Expected error occurred)")
-				}
+	if tc.shouldFail {
+		var exitErr *exec.ExitError
+		if err == nil {
+			return errors.New("Expected error, but got none.")
+		}
+		if tc.exitCode != 0 && (!errors.As(err, &exitErr) || exitErr.ExitCode() != tc.exitCode) {
+			return fmt.Errorf("Expected exit status %d, got: %v", tc.exitCode, err)
+		}
+		if tc.expected != "" && tc.stdoutFile != "" {
+			if err := compareFiles(tc.stdoutFile, tc.expected); err != nil {
+				return err
 			}
-		} else {
-			if err != nil {
-				fmt.Printf("Test FAILED: %s\n%s\n", err, stderr.String())
-				failedTests++
-			} else {
-				var outputFilePath string
-				if tc.stdoutFile != "" {
-					outputFilePath = tc.stdoutFile
-				} else {
-					outputFilePath = tc.output
-				}
-
-				if err := compareFiles(outputFilePath, tc.expected); err != nil {
-					fmt.Printf("Test FAILED: %s\n", err)
-					failedTests++
-				} else {
-					fmt.Println("Test PASSED.")
+		}
+		if tc.expectedError != "" {
+			errorOutput := stderr.Bytes()
+			if tc.stderrFile != "" {
+				var readErr error
+				if errorOutput, readErr = os.ReadFile(tc.stderrFile); readErr != nil {
+					return fmt.Errorf("could not read stderr: %v", readErr)
 				}
 			}
+			if !bytes.Contains(errorOutput, []byte(tc.expectedError)) {
+				return fmt.Errorf("Expected error message '%s' not found in stderr.", tc.expectedError)
+			}
 		}
+		return nil
 	}
 
-	fmt.Println("\n--- Test Summary ---")
-	fmt.Printf("Total tests: %d\n", len(tests))
-	fmt.Printf("Failed tests: %d\n", failedTests)
+	if err != nil {
+		return fmt.Errorf("%s\n%s", err, stderr.String())
+	}
 
-	fmt.Println("\nCleaning up generated test output files...")
-	// cleanup()
+	outputFilePath := tc.output
+	if tc.stdoutFile != "" {
+		outputFilePath = tc.stdoutFile
+	}
+	if tc.exact {
+		err = compareFilesExact(outputFilePath, tc.expected)
+	} else {
+		err = compareFiles(outputFilePath, tc.expected)
+	}
+	if err == nil && tc.expectedStderr != "" && !bytes.Contains(stderr.Bytes(), []byte(tc.expectedStderr)) {
+		err = fmt.Errorf("expected '%s' not found in stderr", tc.expectedStderr)
+	}
+	if err == nil && tc.silent && (stdout.Len() > 0 || stderr.Len() > 0) {
+		err = fmt.Errorf("expected no console output, got stdout %q and stderr %q", stdout.String(), stderr.String())
+	}
+	if err == nil && tc.outputMode != 0 && runtime.GOOS != "windows" {
+		err = checkFileMode(tc.output, tc.outputMode)
+	}
+	for extraOutput, extraExpected := range tc.extraOutputs {
+		if err != nil {
+			break
+		}
+		err = compareFiles(extraOutput, extraExpected)
+	}
+	return err
+}
 
-	if failedTests > 0 {
-		os.Exit(1)
+func checkAbsent(files []string) error {
+	for _, file := range files {
+		if _, err := os.Stat(file); err == nil {
+			return fmt.Errorf("file %s should not exist", file)
+		}
 	}
+	return nil
 }
 
 func compareFiles(file1, file2 string) error {
@@ -284,6 +1553,32 @@ func compareFiles(file1, file2 string) error {
 	return nil
 }
 
+func compareFilesExact(file1, file2 string) error {
+	content1, err := os.ReadFile(file1)
+	if err != nil {
+		return fmt.Errorf("error reading file %s: %v", file1, err)
+	}
+	content2, err := os.ReadFile(file2)
+	if err != nil {
+		return fmt.Errorf("error reading file %s: %v", file2, err)
+	}
+	if !bytes.Equal(content1, content2) {
+		return fmt.Errorf("output mismatch between %s and %s", file1, file2)
+	}
+	return nil
+}
+
+func checkFileMode(file string, expected os.FileMode) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("error reading file %s: %v", file, err)
+	}
+	if info.Mode().Perm() != expected {
+		return fmt.Errorf("file %s has mode %04o, expected %04o", file, info.Mode().Perm(), expected)
+	}
+	return nil
+}
+
 func cleanup() {
 	files, err := filepath.Glob("tests/output_*")
 	if err != nil {
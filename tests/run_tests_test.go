@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestEndToEnd runs each case of run_tests.go as a subtest, so that the end-to-end
+// cases also run with go test.
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end tests in short mode")
+	}
+	// The cases use paths relative to the repository root.
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(".."); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	executablePath, err := buildExecutable(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cleanupOutputs)
+
+	for _, tc := range testCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := runTestCase(executablePath, tc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// cleanupOutputs removes the output files written by the cases. Unlike cleanup, it
+// leaves the tests/error_* files alone, as some of them are checked in.
+func cleanupOutputs() {
+	files, _ := filepath.Glob("tests/output_*")
+	for _, file := range files {
+		os.RemoveAll(file)
+	}
+}